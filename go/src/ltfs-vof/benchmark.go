@@ -0,0 +1,125 @@
+// reads the simulated tapes once with each schedule and compares the cache and time
+// each needed, the estimates of a dry run are checked against real reads this way
+package main
+
+import (
+	"fmt"
+	"io"
+	. "ltfs-vof/utils"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const BENCHMARK_SUFFIX string = "-benchmark-"
+
+// the result of reading the tapes with one schedule
+type scheduleBenchmark struct {
+	Schedule   string
+	Tapes      int
+	PeakCache  int64
+	EndCache   int64
+	Uploaded   int
+	Incomplete int
+	Elapsed    time.Duration
+}
+
+// each schedule reads a copy of the catalog and cache to a null target so every run
+// starts from the same state and the catalog is left ready for the restore
+func (db *Database) BenchmarkSchedules(dbName, cacheDir string, schedules []string, allowMissing bool) []*scheduleBenchmark {
+	var results []*scheduleBenchmark
+	for _, schedule := range schedules {
+		benchDB, benchCache := copyCatalog(dbName, cacheDir, BENCHMARK_SUFFIX+schedule, db.logger)
+		dbManager := db.dbManager.copyTo(benchDB, benchCache, NewNullTarget(db.logger))
+		run := NewDatabase(db.versionCache, dbManager, db.library, db.logger)
+		run.SetRetryPolicy(db.retry)
+		run.SetSchedule(schedule, db.timing)
+
+		fmt.Fprintln(Console, "\nBENCHMARK, schedule: ", schedule)
+		start := time.Now()
+		if !run.RestoreAll(allowMissing) {
+			db.logger.Fatal("Benchmark not started, tapes are missing from the library")
+		}
+		result := &scheduleBenchmark{Schedule: schedule, Tapes: len(run.tapesRead), Elapsed: time.Since(start)}
+		result.EndCache, _, result.PeakCache, _, _ = dbManager.cache.Usage()
+		result.Uploaded, _ = dbManager.UploadCounts()
+		result.Incomplete = len(dbManager.GetIncompleteVersions())
+		dbManager.target.Close()
+		dbManager.Close()
+		os.Remove(benchDB)
+		os.RemoveAll(benchCache)
+		db.logger.Event("Benchmark, schedule: ", schedule, " tapes: ", result.Tapes, " peak cache: ", result.PeakCache, " end cache: ", result.EndCache, " uploaded: ", result.Uploaded, " incomplete: ", result.Incomplete, " elapsed: ", result.Elapsed)
+		results = append(results, result)
+	}
+
+	fmt.Fprintln(Console, "\nSchedule\tTapes\tPeak Cache\tStaged At End\tUploaded\tIncomplete\tElapsed")
+	for _, result := range results {
+		fmt.Fprintf(Console, "%-16s%d\t%-16d%-16d%-16d%-16d%s\n", result.Schedule, result.Tapes, result.PeakCache, result.EndCache, result.Uploaded, result.Incomplete, result.Elapsed.Round(time.Millisecond))
+	}
+	return results
+}
+
+// a manager of a copy of the catalog with the same filter, upload pool and cache quota
+func (dbm *DBManager) copyTo(dbName, cacheDir string, target Target) *DBManager {
+	manager := NewDBManager(dbName, cacheDir, false, target, dbm.logger)
+	manager.SetFilter(dbm.filter)
+	manager.SetUploadPool(dbm.uploadWorkers, dbm.uploadDepth)
+	_, limit, _, _, _ := dbm.cache.Usage()
+	manager.SetCacheQuota(limit)
+	return manager
+}
+
+// copies the catalog and cache so a run can read the tapes without changing them, the
+// copy is made again by each run
+func copyCatalog(dbName, cacheDir, suffix string, logger *Logger) (string, string) {
+	copyDB := dbName + suffix
+	copyCache := cacheDir + suffix
+	if err := copyFile(dbName, copyDB); err != nil {
+		logger.Fatal("Unable to copy the catalog: ", err)
+	}
+	os.RemoveAll(copyCache)
+	err := filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(cacheDir, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(copyCache, relative), 0777)
+		}
+		return linkFile(path, filepath.Join(copyCache, relative))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		logger.Fatal("Unable to copy the cache: ", err)
+	}
+	logger.Event("Using catalog copy: ", copyDB, " cache copy: ", copyCache)
+	return copyDB, copyCache
+}
+
+// cached blocks are never changed in place, a new block is written to a new file, so the
+// copy links to them and only copies when the cache is on a file system without links
+func linkFile(from, to string) error {
+	if err := os.Link(from, to); err == nil {
+		return nil
+	}
+	return copyFile(from, to)
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,186 @@
+// keeps the block cache under a quota, tape reading waits for uploads to free space
+// when the quota is reached
+package main
+
+import (
+	"fmt"
+	. "ltfs-vof/utils"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type CacheQuota struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	limit   int64            // zero is no limit
+	used    int64            // bytes in the cache
+	buckets map[string]int64 // bytes in the cache for each bucket
+	peak    int64
+	spilled int64 // bytes written over the quota because no upload could free space
+}
+
+// the bytes already in the cache directory are counted, e.g. blocks left by an earlier run
+func NewCacheQuota(limit int64, cacheDir string) *CacheQuota {
+	c := &CacheQuota{
+		limit:   limit,
+		buckets: make(map[string]int64),
+	}
+	c.cond = sync.NewCond(&c.mutex)
+	c.buckets = cacheDirectoryUsage(cacheDir)
+	for _, bytes := range c.buckets {
+		c.used += bytes
+	}
+	c.peak = c.used
+	return c
+}
+
+// bytes in each bucket directory of the cache
+func cacheDirectoryUsage(cacheDir string) map[string]int64 {
+	usage := make(map[string]int64)
+	dirs, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return usage
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(cacheDir + "/" + dir.Name())
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if info, err := file.Info(); err == nil {
+				usage[dir.Name()] += info.Size()
+			}
+		}
+	}
+	return usage
+}
+
+// count a block written to the cache
+func (c *CacheQuota) Add(bucket string, bytes int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.used += bytes
+	c.buckets[bucket] += bytes
+	if c.used > c.peak {
+		c.peak = c.used
+	}
+	if c.limit > 0 && c.used > c.limit {
+		over := c.used - c.limit
+		if over > bytes {
+			over = bytes
+		}
+		c.spilled += over
+	}
+}
+
+// count a block removed from the cache
+func (c *CacheQuota) Release(bucket string, bytes int64) {
+	c.mutex.Lock()
+	c.used -= bytes
+	c.buckets[bucket] -= bytes
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+}
+
+// wake readers waiting on the quota so they check the uploads again
+func (c *CacheQuota) Wake() {
+	c.mutex.Lock()
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+}
+
+// block while the cache is full and uploads are under way that will free space,
+// if nothing is being uploaded the reader carries on and the bytes are spilled
+// over the quota. Returns how long the reader waited
+func (c *CacheQuota) WaitForRoom(uploading func() int) time.Duration {
+	start := time.Now()
+	c.mutex.Lock()
+	for c.limit > 0 && c.used >= c.limit && uploading() > 0 {
+		c.cond.Wait()
+	}
+	c.mutex.Unlock()
+	return time.Since(start)
+}
+
+// returns the bytes used, the quota, the peak use, the bytes spilled over the
+// quota and the bytes used by each bucket
+func (c *CacheQuota) Usage() (int64, int64, int64, int64, map[string]int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	buckets := make(map[string]int64)
+	for bucket, bytes := range c.buckets {
+		buckets[bucket] = bytes
+	}
+	return c.used, c.limit, c.peak, c.spilled, buckets
+}
+
+// versions waiting in the cache for blocks still to be read
+type CacheStatus struct {
+	PinnedBytes   int64 // cached bytes of versions waiting on blocks not yet read
+	PendingCount  int   // versions not yet uploaded
+	OldestVersion string
+	OldestKey     string
+	OldestTime    time.Time
+}
+
+// walk the versions that are not uploaded to find the oldest and the bytes pinned in the cache
+func (dbm *DBManager) GetCacheStatus() CacheStatus {
+	dbm.lock()
+	defer dbm.unlock()
+	var status CacheStatus
+	versions := dbm.getAllVersionsNotCompleted()
+	status.PendingCount = len(versions)
+	for i, versionID := range versions {
+		bucketkey, _, _, _, blockids := dbm.getVersionInfo(versionID)
+		if i == 0 {
+			status.OldestVersion = versionID
+			status.OldestKey = bucketkey
+			_, created := GetTimeFromID(versionID, dbm.logger)
+			status.OldestTime = time.UnixMilli(int64(created))
+		}
+		bucket, _ := dbm.getBucketKey(bucketkey)
+		for _, blockid := range blockids {
+			if state, _ := dbm.getBlockRecord(blockid); state != STATE_CACHED {
+				continue
+			}
+			if info, err := os.Stat(dbm.cacheDir + "/" + bucket + "/" + blockid); err == nil {
+				status.PinnedBytes += info.Size()
+			}
+		}
+	}
+	return status
+}
+
+// print the cache use, pinned bytes and the oldest version waiting to be uploaded
+func (db *Database) PrintCacheStatus() {
+	used, limit, peak, spilled, buckets := db.dbManager.cache.Usage()
+	status := db.dbManager.GetCacheStatus()
+
+	fmt.Fprintln(Console, "\nCACHE STATUS")
+	if limit > 0 {
+		fmt.Fprintf(Console, "Used: %d of %d bytes (%.1f%%)\n", used, limit, float64(used)*100/float64(limit))
+	} else {
+		fmt.Fprintf(Console, "Used: %d bytes, no quota\n", used)
+	}
+	fmt.Fprintln(Console, "Peak: ", peak, "  Spilled Over Quota: ", spilled)
+	fmt.Fprintln(Console, "Pinned (waiting on blocks not yet read): ", status.PinnedBytes)
+	fmt.Fprintln(Console, "Versions Pending Upload: ", status.PendingCount)
+	if status.OldestVersion != "" {
+		fmt.Fprintln(Console, "Oldest Pending Version: ", status.OldestKey, " ", status.OldestVersion, " created ", status.OldestTime.UTC().Format(time.RFC3339))
+	}
+	var names []string
+	for bucket := range buckets {
+		names = append(names, bucket)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(Console, "\nBucket\t\t\tBytes")
+	for _, bucket := range names {
+		fmt.Fprintf(Console, "%-24s%d\n", bucket, buckets[bucket])
+	}
+	db.logger.Event("Cache Status, used: ", used, " quota: ", limit, " peak: ", peak, " spilled: ", spilled, " pinned: ", status.PinnedBytes, " pending: ", status.PendingCount, " oldest: ", status.OldestVersion, " buckets: ", buckets)
+}
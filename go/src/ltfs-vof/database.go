@@ -11,12 +11,21 @@ import (
 	"slices"
 	"sort"
 	"strings"
+	"time"
 )
 
 type Database struct {
 	versionCache string
 	dbManager    *DBManager
 	library      TapeLibrary
+	retry        RetryPolicy
+	schedule     string      // order the tapes are read in
+	timing       DriveTiming // drives and their performance used to schedule the tapes
+	progress     *Progress
+	control      *RunControl     // pauses or stops reading on signals
+	interval     time.Duration   // time between progress reports, zero for none
+	verifier     *VerifyTarget   // set when every pack is read and checked without a target
+	tapesRead    map[string]bool // the tapes this run reads, nil until a read starts
 	logger       *Logger
 }
 
@@ -26,9 +35,31 @@ func NewDatabase(versionCache string, dbManager *DBManager, library TapeLibrary,
 		dbManager:    dbManager,
 		library:      library,
 		logger:       logger,
+		retry:        RetryPolicy{Attempts: 1},
+		progress:     NewProgress("", dbManager),
+		control:      NewRunControl(),
 	}
 }
 
+// report progress every interval while reading and write it to the status file
+func (db *Database) SetProgress(statusFile string, interval time.Duration) {
+	db.progress = NewProgress(statusFile, db.dbManager)
+	db.interval = interval
+}
+
+// read every pack on every tape and check each TLV, the verifier is also the target
+func (db *Database) SetVerifier(verifier *VerifyTarget) {
+	db.verifier = verifier
+}
+
+func (db *Database) SetRetryPolicy(retry RetryPolicy) {
+	db.retry = retry
+}
+func (db *Database) SetSchedule(schedule string, timing DriveTiming) {
+	db.schedule = schedule
+	db.timing = timing
+}
+
 func (db *Database) GetVersionFiles() {
 	os.RemoveAll(db.versionCache)
 	os.Mkdir(db.versionCache, 0755)
@@ -120,7 +151,7 @@ func (db *Database) readVersionFiles(drive TapeDrive, driveNumber int, tape Tape
 		// copy the version file to the version cache file
 		db.logger.Event("Copy Version File", path, " File: ", cacheFileName)
 		_, err = io.Copy(cacheFile, sourceFile)
-		fmt.Println("Copy Version File", path, " File: ", cacheFileName)
+		fmt.Fprintln(Console, "Copy Version File", path, " File: ", cacheFileName)
 		if err != nil {
 			db.logger.Fatal("unable to copy version file to version cache file", err)
 		}
@@ -151,7 +182,7 @@ func (db *Database) CreateDatabase() {
 	versionFilesToProcess := db.findVersionFilesToProcess(versionFileUlids)
 
 	for _, versionFile := range versionFilesToProcess {
-		fmt.Println("Processing Version File: ", versionFile.String())
+		fmt.Fprintln(Console, "Processing Version File: ", versionFile.String())
 		// open the oldest version file
 		versionFileName := DEFAULT_VERSION_CACHE + "/" + versionFile.String()
 		file, err := os.Open(versionFileName)
@@ -164,11 +195,14 @@ func (db *Database) CreateDatabase() {
 		// read TLV's followed by blocks
 		for {
 			db.logger.Event("Reading TLV ")
-			tlv := ReadTLV(file, db.logger)
-			if tlv == nil {
+			tlv, err := ReadTLV(file, db.logger)
+			if err == io.EOF {
 				db.logger.Event("End of Processing version file: ", versionFileName)
 				break
 			}
+			if err != nil {
+				db.logger.Fatal("Unable to read version file: ", versionFileName, " ", err)
+			}
 			switch tlv.Tag() {
 			case VERSION:
 				v := ReadVersionRecord(file, tlv.DataLength(), db.logger)
@@ -232,8 +266,11 @@ func (db *Database) findVersionFilesToProcess(versionFileUlids []ulid.ULID) []ul
 		db.logger.Event("Checking version file for Metafile: ", versionFileName)
 
 		// only going to read first TLV to determine if metafile exists
-		tlv := ReadTLV(file, db.logger)
-		if tlv == nil {
+		tlv, err := ReadTLV(file, db.logger)
+		if err != nil {
+			if err != io.EOF {
+				db.logger.Event("Unable to read version file: ", versionFileName, " ", err)
+			}
 			// continue to the next version file
 			continue
 		}
@@ -5,27 +5,33 @@ import (
 	"encoding/json"
 	"github.com/oklog/ulid/v2"
 	. "ltfs-vof/utils"
+	"math"
 	_ "modernc.org/sqlite"
 	"os"
 	"sort"
 	"strings"
+	"time"
 )
 
 type DBManager struct {
 	db           *sql.DB
 	cacheDir     string
-	region       string
-	s3Enabled    bool
-	s3Customer   *S3Customer
+	target       Target
+	manifest     *Manifest
 	lockResource *Resource
 	lockValue    int
-	logger       *Logger
+	filter       *RestoreFilter
+	uploads      *Uploader
+	cache        *CacheQuota
+	// upload pool size and the versions queued before readers wait
+	uploadWorkers int
+	uploadDepth   int
+	logger        *Logger
 }
 
-func NewDBManager(dbName, cacheDir, region string, clean, s3Enabled, versioned, simulation bool, logger *Logger) *DBManager {
+func NewDBManager(dbName, cacheDir string, clean bool, target Target, logger *Logger) *DBManager {
 	var manager DBManager
-	manager.region = region
-	manager.s3Enabled = s3Enabled
+	manager.target = target
 	manager.lockResource = NewResource(1)
 	manager.cacheDir = cacheDir
 	manager.logger = logger
@@ -52,7 +58,7 @@ func NewDBManager(dbName, cacheDir, region string, clean, s3Enabled, versioned,
 			logger.Fatal("Could not create block table", err)
 		}
 		// create versions table
-		_, err = manager.db.Exec(`CREATE TABLE versions (versionid TEXT NOT NULL PRIMARY KEY, bucketkey string KEY, inrecord BOOL KEY, completed BOOL DEFAULT false, deletemarker BOOL default false, ispacklist BOOL default false, blocklist BLOB )`)
+		_, err = manager.db.Exec(`CREATE TABLE versions (versionid TEXT NOT NULL PRIMARY KEY, bucketkey string KEY, inrecord BOOL KEY, completed BOOL DEFAULT false, deletemarker BOOL default false, ispacklist BOOL default false, blocklist BLOB, meta BLOB )`)
 		if err != nil {
 			logger.Fatal("Could not create version table", err)
 		}
@@ -61,16 +67,22 @@ func NewDBManager(dbName, cacheDir, region string, clean, s3Enabled, versioned,
 		if err != nil {
 			logger.Fatal("Could not create pack table", err)
 		}
-		// remove everything from the cache directory
-		if !s3Enabled {
-			os.RemoveAll(manager.cacheDir)
-			os.Mkdir(cacheDir, 0777)
-		}
 	}
-	// create s3 customer service if enabled
-	if s3Enabled {
-		manager.s3Customer = NewS3Customer(region, cacheDir, versioned, simulation, logger)
+	// the state of each tape read, kept across runs
+	_, err = manager.db.Exec(`CREATE TABLE IF NOT EXISTS tapes (tapeid TEXT NOT NULL PRIMARY KEY, state INT default 0, error TEXT)`)
+	if err != nil {
+		logger.Fatal("Could not create tape table", err)
+	}
+	// catalogs built before the version metadata was kept do not have the column
+	_, err = manager.db.Exec(`ALTER TABLE versions ADD COLUMN meta BLOB`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") && !strings.Contains(err.Error(), "no such table") {
+		logger.Fatal("Could not add meta column to version table", err)
 	}
+	// the target version of each restored version, kept across runs
+	manager.createVersionMapTable()
+	// count the bytes in the cache, there is no quota until one is set
+	manager.cache = NewCacheQuota(0, cacheDir)
+	manager.updateCacheMetric()
 
 	return &manager
 }
@@ -80,17 +92,140 @@ func (dbm *DBManager) lock() {
 func (dbm *DBManager) unlock() {
 	dbm.lockResource.Release(dbm.lockValue)
 }
-func (dbm *DBManager) Compare() bool {
-	return dbm.s3Customer.Compare()
+
+// check what the target was sent during this run
+func (dbm *DBManager) VerifyTarget() bool {
+	return dbm.target.Verify()
+}
+
+// restrict the versions added to the database and restored to those matching the filter
+func (dbm *DBManager) SetFilter(filter *RestoreFilter) {
+	dbm.filter = filter
+}
+
+// true if the version is in the version table and is selected by the filter
+func (dbm *DBManager) IsVersionSelected(versionID string) bool {
+	bucketkey, _, _, _, _, exist := dbm.getVersionRecord(versionID)
+	if !exist {
+		return false
+	}
+	return dbm.filter.MatchBucketKey(bucketkey, versionID)
+}
+
+// restrict the filter to the version of each key that was current at the time given,
+// keys whose current version was a delete marker or that did not exist are not restored
+func (dbm *DBManager) SelectVersionsAsOf(asOf time.Time) int {
+	return dbm.selectCurrentVersions(uint64(asOf.UnixMilli()))
+}
+
+// restrict the filter to the live version of each key, superseded versions and keys
+// whose newest version is a delete marker are not restored
+func (dbm *DBManager) SelectLatestVersions() int {
+	return dbm.selectCurrentVersions(math.MaxUint64)
+}
+
+// selects the newest version of each key created at or before the cutoff in ms
+func (dbm *DBManager) selectCurrentVersions(cutoff uint64) int {
+	dbm.lock()
+	defer dbm.unlock()
+
+	// group the selected versions not yet restored by bucket and key
+	keyVersions := make(map[string][]string)
+	deleteMarkers := make(map[string]bool)
+	v, err := dbm.db.Query("SELECT versionid, bucketkey, deletemarker FROM versions")
+	if err != nil {
+		dbm.logger.Fatal("Could not read versions", err)
+	}
+	for v.Next() {
+		var versionid string
+		var bucketkey string
+		var deleteMarker int
+		err = v.Scan(&versionid, &bucketkey, &deleteMarker)
+		if err != nil {
+			dbm.logger.Fatal("Could not read versionid", err)
+		}
+		if !dbm.filter.MatchBucketKey(bucketkey, versionid) {
+			continue
+		}
+		keyVersions[bucketkey] = append(keyVersions[bucketkey], versionid)
+		deleteMarkers[versionid] = deleteMarker == 1
+	}
+	v.Close()
+
+	// versions restored by an earlier run still count when choosing the current version
+	// of a key, so an older version is not restored over the one that was current
+	restored := make(map[string]bool)
+	v, err = dbm.db.Query("SELECT versionid, bucket, objectkey, deletemarker FROM versionmap")
+	if err != nil {
+		dbm.logger.Fatal("Could not read version map", err)
+	}
+	for v.Next() {
+		var versionid, bucket, key string
+		var deleteMarker int
+		err = v.Scan(&versionid, &bucket, &key, &deleteMarker)
+		if err != nil {
+			dbm.logger.Fatal("Could not read version map", err)
+		}
+		bucketkey := dbm.createBucketKey(bucket, key)
+		if !dbm.filter.MatchBucketKey(bucketkey, versionid) {
+			continue
+		}
+		keyVersions[bucketkey] = append(keyVersions[bucketkey], versionid)
+		deleteMarkers[versionid] = deleteMarker == 1
+		restored[versionid] = true
+	}
+	v.Close()
+
+	// the newest version of each key created at or before the cutoff is the current one
+	selected := make(map[string]bool)
+	for bucketkey, versions := range keyVersions {
+		var current string
+		var currentTime uint64
+		for _, versionid := range versions {
+			_, created := GetTimeFromID(versionid, dbm.logger)
+			if created > cutoff {
+				continue
+			}
+			if current == "" || created >= currentTime {
+				current = versionid
+				currentTime = created
+			}
+		}
+		if current == "" {
+			dbm.logger.Event("Key did not exist at cutoff: ", bucketkey)
+			continue
+		}
+		if restored[current] {
+			dbm.logger.Event("Current version already restored: ", bucketkey)
+			continue
+		}
+		if deleteMarkers[current] {
+			dbm.logger.Event("Key deleted by delete marker: ", bucketkey)
+			continue
+		}
+		selected[current] = true
+	}
+	if dbm.filter == nil {
+		dbm.filter = &RestoreFilter{}
+	}
+	dbm.filter.SelectVersions(selected)
+	return len(selected)
 }
 
 // add a version to the version table
 func (dbm *DBManager) AddVersion(mr *MetaReference) {
 	dbm.lock()
 	bucketObject := mr.GetBucketObject()
+	// skip versions not selected by the filter
+	if !dbm.filter.Match(mr.GetBucket(), mr.GetObject(), mr.GetVersion()) {
+		dbm.logger.Event("Version not selected by filter: ", bucketObject, " version: ", mr.GetVersion())
+		dbm.unlock()
+		return
+	}
 	// if delete marker then just add it to version table
 	if mr.GetIsDeleteMarker() {
 		dbm.insertVersionTable(bucketObject, mr.GetVersion(), false, true, false, nil)
+		dbm.updateVersionMeta(mr.GetVersion(), NewVersionMeta(mr))
 		dbm.unlock()
 		return
 	}
@@ -157,11 +292,18 @@ func (dbm *DBManager) AddVersion(mr *MetaReference) {
 	} else {
 		dbm.logger.Fatal("Version added that doesn't have data in the version, packs or a packlist")
 	}
+	dbm.updateVersionMeta(mr.GetVersion(), NewVersionMeta(mr))
 	dbm.unlock()
 }
 
 func (dbm *DBManager) DeleteVersion(version string) {
 
+	// the version may never have been added because it was not selected by the filter
+	if !dbm.doesVersionRecordExist(version) {
+		dbm.logger.Event("Deleted version not in version table: ", version)
+		return
+	}
+
 	// get the blocklist from the version table
 	_, _, _, _, blockids := dbm.getVersionInfo(version)
 
@@ -192,6 +334,7 @@ func (dbm *DBManager) WriteBlock(pack string, blockStartLocation, blockEndLocati
 		entry.SetPhysicalLength(blockEndLocation - blockStartLocation)
 
 		// insert the pack list entry into the block table, and change its state to cached
+		metricOrphans.Inc()
 		blockID := dbm.insertBlocksTable(entry)
 		dbm.updateBlockRecordState(blockID, STATE_CACHED)
 
@@ -251,6 +394,35 @@ func (dbm *DBManager) WriteBlock(pack string, blockStartLocation, blockEndLocati
 	dbm.logger.Event("Process Version: ", packMapEntry.VersionID)
 	dbm.processVersion(packMapEntry.VersionID)
 	dbm.unlock()
+	dbm.uploads.WaitForRoom()
+}
+
+// true if the block at the offset in the pack has to be read, blocks of versions that were
+// deleted, not selected or already uploaded are skipped. A block the catalog does not know
+// about is only needed while a pack list that may claim it is unread
+func (dbm *DBManager) IsBlockNeeded(pack string, offset int64, unresolved bool) bool {
+	dbm.lock()
+	defer dbm.unlock()
+	entry, ok := dbm.getPackMap(pack)[offset]
+	if !ok {
+		return unresolved
+	}
+	// an orphan already in the cache or a block of a version not being restored
+	if entry.VersionID == "" || !dbm.IsVersionSelected(entry.VersionID) {
+		return false
+	}
+	if entry.BlockID == "" {
+		return true
+	}
+	state, _ := dbm.getBlockRecord(entry.BlockID)
+	return state == STATE_READY
+}
+
+// true if a selected version is still waiting for its pack list to be read
+func (dbm *DBManager) HasUnresolvedPackLists() bool {
+	dbm.lock()
+	defer dbm.unlock()
+	return dbm.hasUnresolvedPackLists()
 }
 
 // Encountered a pack list need, to create or update the blocks associated with the list,
@@ -266,6 +438,18 @@ func (dbm *DBManager) ProcessPackList(packName string, offset int64, packlist []
 		dbm.logger.Fatal("Could not find pack entry for pack list", packName, " offset ", offset)
 	}
 	versionID := packEntry.VersionID
+	// the version may have been deleted or not selected by the filter
+	if !dbm.IsVersionSelected(versionID) {
+		dbm.logger.Event("Pack list for version not being restored: ", versionID)
+		dbm.unlock()
+		return
+	}
+	// the pack list has already been read, e.g. the pack is being read again
+	if _, _, _, _, blockids := dbm.getVersionInfo(versionID); len(blockids) > 0 {
+		dbm.logger.Event("Pack list already processed for version: ", versionID)
+		dbm.unlock()
+		return
+	}
 	// step 2: for block entries that don't exist create them, if they have already
 	// been seen then there will a map to them and they need to be updated with
 	// logical locations specified in pack map
@@ -323,6 +507,7 @@ func (dbm *DBManager) ProcessPackList(packName string, offset int64, packlist []
 	// step 5: process the version in case all blocks are cahced
 	dbm.processVersion(versionID)
 	dbm.unlock()
+	dbm.uploads.WaitForRoom()
 }
 
 func (dbm *DBManager) processVersion(versionID string) {
@@ -366,33 +551,20 @@ func (dbm *DBManager) processVersion(versionID string) {
 			return
 		}
 		bucket, key := dbm.getBucketKey(bucketkey)
-		// if this is a not a delete marker send it to s3 if enabled
+		job := &uploadJob{versionID: versionID, bucket: bucket, key: key, deleteMarker: deleteMarker}
+		job.meta = dbm.getVersionMeta(versionID)
 		if !deleteMarker {
 			// sort the blocks in starting logical order
-			blockids = dbm.sortBlockOrder(bucket, blockids)
-
-			// if s3 enabled write version to S3
-			if dbm.s3Enabled {
-				dbm.logger.Event("S3, Put Object, bucket: ", bucket, "  key: ", key, "  Region: ", dbm.region, " Block count: ", len(blockids))
-				dbm.s3Customer.Put(bucket, key, blockids)
-			}
-
-			// remove the block data from the cache and delete the blockid records
-			for _, blockid := range blockids {
-				dbm.removeBlockFromCache(blockid, bucket)
-				dbm.deleteBlockRecord(blockid)
-			}
-		} else {
-			// delete marker
-			if dbm.s3Enabled {
-				dbm.logger.Event("S3, Delete Marker, bucket: ", bucket, "  key: ", key, "  Region: ", dbm.region)
-				dbm.s3Customer.Delete(bucket, key)
-				// DeleteMarker(bucket, key, dbm.region)
+			job.blockids = dbm.sortBlockOrder(bucket, blockids)
+			if dbm.manifest != nil {
+				job.sources = dbm.getVersionSources(job.blockids)
 			}
 		}
 
-		// Delete the version from the version table
-		dbm.deleteVersionsTable(versionID)
+		// mark the version completed so the next version of the key can be queued
+		// behind it, the upload workers remove it once it is on the target
+		dbm.updateVersionCompletedState(versionID)
+		dbm.uploads.Enqueue(job)
 
 		// if there is not another version then break, otherwise loop and process
 		// the next version
@@ -404,57 +576,162 @@ func (dbm *DBManager) processVersion(versionID string) {
 	}
 }
 
-// returns ordered list of tapes from oldest to newest and map of
-// tapes to the packs on the tapes also ordered from oldest to newest
-func (dbm *DBManager) GetTapePackOrder() ([]string, map[string][]string) {
+// send a version to the target and then remove its blocks from the cache and its records
+func (dbm *DBManager) upload(job *uploadJob) {
+	dbm.target.EnsureBucket(job.bucket, job.key)
+	var result *TargetResult
+	if !job.deleteMarker {
+		result = dbm.target.PutVersion(job.bucket, job.key, job.versionID, job.blockids, job.meta)
+		metricVersionsUploaded.Inc()
+	} else {
+		result = dbm.target.DeleteMarker(job.bucket, job.key, job.versionID, job.meta)
+		metricDeleteMarkers.Inc()
+	}
+	if dbm.manifest != nil {
+		record := &ManifestRecord{
+			Bucket:          job.bucket,
+			Key:             job.key,
+			VersionID:       job.versionID,
+			DeleteMarker:    job.deleteMarker,
+			Size:            job.meta.Size,
+			ETag:            job.meta.ETag,
+			Sources:         job.sources,
+			TargetBucket:    result.Bucket,
+			TargetKey:       result.Key,
+			TargetVersionID: result.VersionID,
+			TargetETag:      result.ETag,
+			Uploaded:        time.Now().UTC(),
+			Verification:    MANIFEST_UNCHECKED,
+		}
+		if !job.deleteMarker {
+			record.Verification = etagVerification(job.meta.ETag, result.ETag)
+		}
+		dbm.manifest.Write(record)
+	}
 
-	// create a map of tape id to packs
 	dbm.lock()
-	tapeids, packids := dbm.getTapesPacksTable()
-	dbm.unlock()
-	tapepacks := make(map[string][]string)
-	for i, tapeid := range tapeids {
-		_, ok := tapepacks[tapeid]
-		if !ok {
-			tapepacks[tapeid] = make([]string, 0)
-		}
-		// add this pack to the
-		tapepacks[tapeid] = append(tapepacks[tapeid], packids[i])
-	}
-	var orderedList []string
-
-	// now sort the from oldest to newest for each tape
-	for tape, packids := range tapepacks {
-		// convert the slice to a time based slide
-		packtimes := make([]uint64, 0)
-		for _, packid := range packids {
-			// remove the suffix from the packid
-			dbm.logger.Event("Get time from ID: ", packid)
-			_, packtime := GetTimeFromID(packid, dbm.logger)
-			packtimes = append(packtimes, packtime)
-		}
-		// sort the packids based on the time
-		sort.Slice(packtimes, func(i, j int) bool {
-			if packtimes[i] < packtimes[j] {
-				packids[i], packids[j] = packids[j], packids[i]
-				return true
-			}
-			return false
-		})
-		// create a currently unordered list of tapes
-		orderedList = append(orderedList, tape)
-	}
-	// create the ordered list of tapes based on oldest pack time of
-	// first element
-	sort.Slice(orderedList, func(i, j int) bool {
-		_, oldi := GetTimeFromID(tapepacks[orderedList[i]][0], dbm.logger)
-		_, oldj := GetTimeFromID(tapepacks[orderedList[j]][0], dbm.logger)
-		if oldi < oldj {
-			return true
-		}
-		return false
+	// remove the block data from the cache and delete the blockid records
+	for _, blockid := range job.blockids {
+		dbm.removeBlockFromCache(blockid, job.bucket)
+		dbm.deleteBlockRecord(blockid)
+	}
+	// keep the restored version and the version the target created, if any, once the
+	// version row is gone
+	dbm.insertVersionMap(&VersionMapping{
+		VersionID:       job.versionID,
+		TargetVersionID: result.VersionID,
+		Bucket:          job.bucket,
+		Key:             job.key,
+		TargetBucket:    result.Bucket,
+		TargetKey:       result.Key,
+		DeleteMarker:    job.deleteMarker,
+		Restored:        time.Now(),
 	})
-	return orderedList, tapepacks
+	// Delete the version from the version table
+	dbm.deleteVersionsTable(job.versionID)
+	dbm.unlock()
+}
+
+// record each version sent to the target in the manifest
+func (dbm *DBManager) SetManifest(manifest *Manifest) {
+	dbm.manifest = manifest
+}
+
+// set the number of upload workers and the number of versions queued before
+// tape reading waits for the uploads
+func (dbm *DBManager) SetUploadPool(workers, depth int) {
+	dbm.uploadWorkers = workers
+	dbm.uploadDepth = depth
+}
+
+// start the upload workers, versions left completed by a run that stopped before
+// they were uploaded are made pending again
+func (dbm *DBManager) StartUploads() {
+	dbm.lock()
+	_, err := dbm.db.Exec("UPDATE versions SET completed = 0 WHERE completed = 1")
+	if err != nil {
+		dbm.logger.Fatal("Could not reset completed versions", err)
+	}
+	dbm.unlock()
+	dbm.uploads = NewUploader(dbm.uploadWorkers, dbm.uploadDepth, dbm)
+	dbm.logger.Event("Started upload workers: ", dbm.uploadWorkers, " queue depth: ", dbm.uploadDepth)
+}
+
+// the gauge is set from the quota so blocks left in the cache by an earlier run are counted
+func (dbm *DBManager) updateCacheMetric() {
+	used, _, _, _, _ := dbm.cache.Usage()
+	metricCacheBytes.Set(float64(used))
+}
+
+// the cache quota in bytes, zero is no quota
+func (dbm *DBManager) SetCacheQuota(limit int64) {
+	dbm.cache.mutex.Lock()
+	dbm.cache.limit = limit
+	dbm.cache.mutex.Unlock()
+}
+
+// called by readers before caching a block, waits while the cache is over its quota
+// and uploads are under way that will free space
+func (dbm *DBManager) WaitForCache() time.Duration {
+	return dbm.cache.WaitForRoom(dbm.uploads.Pending)
+}
+
+// close the catalog once no more updates will be made
+func (dbm *DBManager) Close() {
+	dbm.lock()
+	defer dbm.unlock()
+	if err := dbm.db.Close(); err != nil {
+		dbm.logger.Event("Could not close db", err)
+	}
+}
+
+// returns the versions uploaded and the versions queued or being uploaded
+func (dbm *DBManager) UploadCounts() (int, int) {
+	if dbm.uploads == nil {
+		return 0, 0
+	}
+	return dbm.uploads.Counts()
+}
+
+// returns the number of selected versions not yet uploaded
+func (dbm *DBManager) CountVersionsNotCompleted() int {
+	dbm.lock()
+	defer dbm.unlock()
+	return len(dbm.getAllVersionsNotCompleted())
+}
+
+// wait for every queued version to be uploaded
+func (dbm *DBManager) FinishUploads() {
+	dbm.uploads.Close()
+	dbm.logger.Event("Upload workers finished")
+}
+
+// process a version that may be complete without holding the database lock
+func (dbm *DBManager) ProcessVersion(versionID string) {
+	dbm.lock()
+	dbm.processVersion(versionID)
+	dbm.unlock()
+	dbm.uploads.WaitForRoom()
+}
+
+// process every version not yet uploaded, a version whose blocks are all cached, because
+// its data is in the version record or an earlier run read them, is queued now as no
+// block read from tape will complete it
+func (dbm *DBManager) ProcessCachedVersions() int {
+	dbm.lock()
+	versions := dbm.getAllVersionsNotCompleted()
+	dbm.unlock()
+	for _, versionID := range versions {
+		dbm.ProcessVersion(versionID)
+	}
+	return len(versions)
+}
+
+// returns ordered list of tapes from oldest to newest and map of
+// tapes to the packs on the tapes also ordered from oldest to newest
+func (dbm *DBManager) GetTapePackOrder() ([]string, map[string][]string) {
+	plan := dbm.PlanTapes()
+	return plan.Tapes, plan.Packs
 }
 
 // add a tape to a pack
@@ -475,6 +752,58 @@ const (
 	STATE_ORPHANED             = 5
 )
 
+type tapeState int
+
+const (
+	TAPE_STATE_READY     tapeState = 0
+	TAPE_STATE_READING             = 1
+	TAPE_STATE_COMPLETED           = 2
+	TAPE_STATE_FAILED              = 3
+)
+
+// record the state of a tape and the error that failed it
+func (dbm *DBManager) SetTapeState(tapeID string, state tapeState, message string) {
+	dbm.lock()
+	defer dbm.unlock()
+	_, err := dbm.db.Exec("INSERT OR REPLACE INTO tapes (tapeid, state, error) VALUES (?,?,?)", tapeID, state, message)
+	if err != nil {
+		dbm.logger.Fatal("Could not update tape state", err)
+	}
+}
+
+// true once a read has been started on the catalog, the target holds what it restored
+func (dbm *DBManager) HasReadTapes() bool {
+	dbm.lock()
+	defer dbm.unlock()
+	var count int
+	err := dbm.db.QueryRow("SELECT COUNT(*) FROM tapes").Scan(&count)
+	if err != nil {
+		dbm.logger.Fatal("Could not read tape table", err)
+	}
+	return count > 0
+}
+
+// returns the failed tapes and their errors
+func (dbm *DBManager) GetFailedTapes() map[string]string {
+	dbm.lock()
+	defer dbm.unlock()
+	failed := make(map[string]string)
+	t, err := dbm.db.Query("SELECT tapeid, error FROM tapes WHERE state = ?", TAPE_STATE_FAILED)
+	if err != nil {
+		dbm.logger.Fatal("Could not read tape table", err)
+	}
+	defer t.Close()
+	for t.Next() {
+		var tapeid string
+		var message string
+		if err = t.Scan(&tapeid, &message); err != nil {
+			dbm.logger.Fatal("Could not read tape table", err)
+		}
+		failed[tapeid] = message
+	}
+	return failed
+}
+
 type PackMapType map[int64]PackMapEntry
 
 type PackMapEntry struct {
@@ -503,6 +832,73 @@ func (dbm *DBManager) deleteVersionsTable(versionid string) {
 	}
 }
 
+// the metadata of a version that is restored with its data
+type VersionMeta struct {
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag,omitempty"`
+	Created      int64             `json:"created,omitempty"`  // unix milliseconds
+	Modified     int64             `json:"modified,omitempty"` // unix milliseconds
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	UserMetadata map[string]string `json:"userMetadata,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+func NewVersionMeta(mr *MetaReference) *VersionMeta {
+	return &VersionMeta{
+		Size:         mr.Len,
+		ETag:         mr.ETag,
+		Created:      mr.Time.UnixMilli(),
+		Modified:     mr.Modified.UnixMilli(),
+		Metadata:     mr.Metadata,
+		UserMetadata: mr.UserMetadata,
+		Tags:         mr.Tags,
+	}
+}
+
+// the last modified time of the version, the time in the version ULID is used when the
+// record has no times and the current time when the version ID is not a ULID
+func (m *VersionMeta) ModTime(versionID string, logger *Logger) time.Time {
+	if m != nil && m.Modified != 0 {
+		return time.UnixMilli(m.Modified)
+	}
+	if m != nil && m.Created != 0 {
+		return time.UnixMilli(m.Created)
+	}
+	id, err := ulid.Parse(versionID)
+	if err != nil {
+		logger.Event("Version has no time and its ID is not a ULID, using the current time: ", versionID, " ", err)
+		return time.Now()
+	}
+	return ulid.Time(id.Time())
+}
+
+func (dbm *DBManager) updateVersionMeta(versionid string, meta *VersionMeta) {
+	metajson, err := json.Marshal(meta)
+	if err != nil {
+		dbm.logger.Fatal("Could not marshal version meta", err)
+	}
+	sql := "UPDATE versions SET meta = ? WHERE versionid = ?"
+	_, err = dbm.db.Exec(sql, metajson, versionid)
+	if err != nil {
+		dbm.logger.Fatal("Could not update version meta", err)
+	}
+}
+
+// returns an empty meta for versions added before the metadata was kept
+func (dbm *DBManager) getVersionMeta(versionid string) *VersionMeta {
+	var metajson []byte
+	var meta VersionMeta
+	err := dbm.db.QueryRow("SELECT meta FROM versions WHERE versionid = ?", versionid).Scan(&metajson)
+	if err != nil || metajson == nil {
+		return &meta
+	}
+	err = json.Unmarshal(metajson, &meta)
+	if err != nil {
+		dbm.logger.Fatal("Could not unmarshal version meta", err)
+	}
+	return &meta
+}
+
 // returns bucketkey, deleteMarker, ispacklist, blocklist
 func (dbm *DBManager) getVersionInfo(versionid string) (string, bool, bool, bool, []string) {
 	buckkey, inRecord, deleteMarker, ispacklist, blocklist, exist := dbm.getVersionRecord(versionid)
@@ -538,24 +934,33 @@ func (dbm *DBManager) getVersionRecord(versionid string) (string, bool, bool, bo
 	return bucketkey, inRecord == 1, deleteMarker == 1, ispacklist == 1, blocklist, true
 }
 
-// get the versions whose data was part of version record
-func (dbm *DBManager) getVersionsInRecord() []string {
+// get every version selected by the filter that has not been completed, oldest to newest
+func (dbm *DBManager) getAllVersionsNotCompleted() []string {
 	var versions []string
 	var err error
 
-	v, err := dbm.db.Query("SELECT versionid FROM versions WHERE inrecord = 1")
+	v, err := dbm.db.Query("SELECT versionid, bucketkey FROM versions WHERE completed = 0")
 	if err != nil {
-		dbm.logger.Fatal("Could not read versions associated with in record", err)
+		dbm.logger.Fatal("Could not read versions that are not completed", err)
 	}
 	defer v.Close()
 	for v.Next() {
 		var versionid string
-		err = v.Scan(&versionid)
+		var bucketkey string
+		err = v.Scan(&versionid, &bucketkey)
 		if err != nil {
 			dbm.logger.Fatal("Could not read versionid", err)
 		}
+		if !dbm.filter.MatchBucketKey(bucketkey, versionid) {
+			continue
+		}
 		versions = append(versions, versionid)
 	}
+	sort.Slice(versions, func(i, j int) bool {
+		_, timei := GetTimeFromID(versions[i], dbm.logger)
+		_, timej := GetTimeFromID(versions[j], dbm.logger)
+		return timei < timej
+	})
 	return versions
 }
 
@@ -577,8 +982,8 @@ func (dbm *DBManager) getVersionsNotCompleted(bucketkey string) []string {
 		if err != nil {
 			dbm.logger.Fatal("Could not read versionid", err)
 		}
-		// add to the array if not completed
-		if completed == 0 {
+		// add to the array if not completed and selected by the filter
+		if completed == 0 && dbm.filter.MatchBucketKey(bucketkey, versionid) {
 			versions = append(versions, versionid)
 		}
 	}
@@ -755,6 +1160,38 @@ func (dbm *DBManager) getPackMap(packID string) (packMap PackMapType) {
 	return packMap
 }
 
+// read the block maps of every pack
+func (dbm *DBManager) getAllPackMaps() map[string]PackMapType {
+	packMaps := make(map[string]PackMapType)
+
+	sql := "SELECT packid, blocklist FROM packs"
+	p, err := dbm.db.Query(sql)
+	if err != nil {
+		dbm.logger.Fatal("Could not read pack table ", err)
+	}
+	defer p.Close()
+	for p.Next() {
+		var packid string
+		var packinfo []byte
+		err = p.Scan(&packid, &packinfo)
+		if err != nil {
+			dbm.logger.Fatal("Could not read pack table", err)
+		}
+		// the packmap might be empty because the pack is made up of a block list
+		if len(packinfo) == 0 {
+			packMaps[packid] = nil
+			continue
+		}
+		var packMap PackMapType
+		err = json.Unmarshal(packinfo, &packMap)
+		if err != nil {
+			dbm.logger.Fatal("Could not unmarshal pack map", err)
+		}
+		packMaps[packid] = packMap
+	}
+	return packMaps
+}
+
 func (dbm *DBManager) insertTapePacksTable(packid, tapeid string) {
 	// getht the blocklist, ignore errors because it may not exist
 	var blockinfo []byte
@@ -798,6 +1235,16 @@ func (dbm *DBManager) getTapesPacksTable() ([]string, []string) {
 	return tapeids, packids
 }
 
+// returns the tape holding each pack
+func (dbm *DBManager) getPackTapes() map[string]string {
+	packTapes := make(map[string]string)
+	tapeids, packids := dbm.getTapesPacksTable()
+	for i, packid := range packids {
+		packTapes[packid] = tapeids[i]
+	}
+	return packTapes
+}
+
 // CACHE/S3 FUNCTIONS
 func (dbm *DBManager) writeBlockToCache(blockid string, block *Block) {
 	// if s3 is enabled then write the block to the S3 repository lost+found
@@ -805,6 +1252,8 @@ func (dbm *DBManager) writeBlockToCache(blockid string, block *Block) {
 	directory := dbm.cacheDir + "/" + block.GetBucket()
 	fileName := directory + "/" + blockid
 	os.Mkdir(directory, 0777)
+	// remove any old file first, it may be linked into a catalog copy
+	os.Remove(fileName)
 	file, err := os.Create(fileName)
 	if err != nil {
 		dbm.logger.Fatal("Could not create/open file", err)
@@ -815,13 +1264,21 @@ func (dbm *DBManager) writeBlockToCache(blockid string, block *Block) {
 	if err != nil {
 		dbm.logger.Fatal("Could not write block to cache", err)
 	}
+	dbm.cache.Add(block.GetBucket(), int64(len(block.GetData())))
+	dbm.updateCacheMetric()
 }
 func (dbm *DBManager) removeBlockFromCache(blockid, bucket string) {
 	fileName := dbm.cacheDir + "/" + bucket + "/" + blockid
+	var size int64
+	if info, err := os.Stat(fileName); err == nil {
+		size = info.Size()
+	}
 	err := os.Remove(fileName)
 	if err != nil {
 		dbm.logger.Fatal("Could not remove block from cache", err)
 	}
+	dbm.cache.Release(bucket, size)
+	dbm.updateCacheMetric()
 }
 
 // sort a list of blocks associated with a version based on logical address
@@ -7,9 +7,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/spectralogic/go-core/codec/value"
 	tlvcore "github.com/spectralogic/go-core/tlv"
+	"io"
 	. "ltfs-vof/utils"
 	"os"
 )
@@ -61,6 +63,24 @@ type ACLs []*ACL
 
 type Timestamp int64
 
+// the unit of the timestamps is not recorded with them, it is taken from the size of the
+// value as seconds, milliseconds, microseconds and nanoseconds since 1970 differ by a
+// thousand times. Returns milliseconds, zero is no time
+func (t Timestamp) UnixMilli() int64 {
+	switch {
+	case t <= 0:
+		return 0
+	case t < 1e11:
+		return int64(t) * 1000
+	case t < 1e14:
+		return int64(t)
+	case t < 1e17:
+		return int64(t) / 1000
+	default:
+		return int64(t) / 1000000
+	}
+}
+
 type VersionID struct {
 	Bucket     string    `codec:"b" json:"bucket"`
 	Object     string    `codec:"o" json:"object" table:"4,30,Object"`
@@ -250,20 +270,25 @@ var Tags map[TagType]tlvcore.Tag = map[TagType]tlvcore.Tag{
 type TLV struct {
 	dataLength uint64
 	tag        TagType
+	header     []byte
 }
 
-// reads a tlv from a version or block file
-func ReadTLV(file *os.File, logger *Logger) *TLV {
+// reads a tlv from a version or block file, io.EOF is returned only at the end of the
+// file, a short header or a read error is returned as an error
+func ReadTLV(file *os.File, logger *Logger) (*TLV, error) {
 
 	var tlv TLV
 	header := make([]byte, 32)
-	_, err := file.Read(header)
+	_, err := io.ReadFull(file, header)
+	if err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("truncated TLV header")
+	}
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	tag, size, _, err := tlvcore.DecodeHeader(header)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to decode TLV header: %v", err)
 	}
 	// find the tag type
 	var found bool
@@ -277,10 +302,11 @@ func ReadTLV(file *os.File, logger *Logger) *TLV {
 	}
 	if !found {
 		logger.Event("Unknown TLV tag found:", tag)
-		return nil
+		return nil, fmt.Errorf("unknown TLV tag: %v", tag)
 	}
 	tlv.dataLength = size
-	return &tlv
+	tlv.header = header
+	return &tlv, nil
 }
 
 // write a TLV header to a file, this is for creating simulated tapes
@@ -299,6 +325,23 @@ func WriteTLV(file *os.File, tag TagType, data []byte, logger *Logger) {
 	}
 }
 
+// read the payload of the TLV and check its header against the header encoded from the
+// payload, the header carries the hash of the payload so a damaged payload or header
+// differs. The payload is read once from the stream and returned to be decoded, an error
+// is returned only when the payload can't be read
+func VerifyTLV(r io.Reader, tlv *TLV, logger *Logger) ([]byte, bool, error) {
+	data := make([]byte, tlv.DataLength())
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, false, fmt.Errorf("unable to read TLV payload: %v", err)
+	}
+	expected := make([]byte, 32)
+	if _, err := tlvcore.EncodeHeader(Tags[tlv.Tag()], data, expected); err != nil {
+		logger.Event("Unable to encode TLV header: ", err)
+		return data, false, nil
+	}
+	return data, bytes.Equal(tlv.header, expected), nil
+}
+
 func (t *TLV) Tag() TagType {
 	return t.tag
 }
@@ -340,20 +383,33 @@ func WriteBlock(file *os.File, b *Block, logger *Logger) {
 	encoder.Write(file, b, b.data, nil)
 }
 
+// encode the block so the TLV header can hold the length of the encoded payload
+func EncodeBlock(b *Block, logger *Logger) []byte {
+	var buffer bytes.Buffer
+	encoder := value.NewEncoder()
+	_, err := encoder.Write(&buffer, b, b.data, nil)
+	if err != nil {
+		logger.Fatal("Unable to encode block", err)
+	}
+	return buffer.Bytes()
+}
+
 // Read is used by application to read a data Block out of a pack
 // a read block does not include the pack information but does include the
 // uploadid: versionid, objectid, and the data
-func ReadBlock(file *os.File, length uint64, logger *Logger) *Block {
+func ReadBlock(file io.Reader, length uint64, logger *Logger) *Block {
 
 	// read the block temporily not encoded
 	var b Block
 	decoder := value.NewDecoder()
 	secondaryData, _, err := decoder.ReadWithBytes(file, &b)
 	if err != nil {
-		logger.Fatal("error reading block data:", err)
+		logger.Event("error reading block data:", err)
+		return nil
 	}
 	if secondaryData == nil {
-		logger.Fatal("Block contains no data")
+		logger.Event("Block contains no data")
+		return nil
 	}
 	b.data = make([]byte, len(secondaryData.Bytes()))
 	copy(b.data, secondaryData.Bytes())
@@ -426,12 +482,13 @@ func (pack *StoredPack) WritePackListRecord(file *os.File, logger *Logger) (int6
 	return start, end - start
 }
 
-func ReadPackListRecord(file *os.File, length uint64, logger *Logger) Packs {
+func ReadPackListRecord(file io.Reader, length uint64, logger *Logger) Packs {
 	var pack StoredPack
 	decoder := value.NewDecoder()
 	_, _, err := decoder.ReadWithBytes(file, &pack)
 	if err != nil {
-		logger.Fatal(err)
+		logger.Event("error reading pack list:", err)
+		return nil
 	}
 
 	return pack.Packs
@@ -0,0 +1,310 @@
+// walks the database the way RestoreAll would without touching the library or the
+// target and estimates the tapes, bytes, objects, S3 requests, cache and time needed
+package main
+
+import (
+	"fmt"
+	. "ltfs-vof/utils"
+	"os"
+	"sort"
+	"time"
+)
+
+// drive performance used to estimate how long a restore will take
+type DriveTiming struct {
+	Drives       int
+	Throughput   float64 // MB/s
+	LoadSeconds  float64 // time to move a tape into a drive and thread it
+	MountSeconds float64 // time to mount LTFS on the tape
+}
+
+// a block that has not been read
+type modelBlock struct {
+	pack    string
+	offset  int64
+	bytes   int64
+	version string
+}
+
+// a version selected for restore
+type modelVersion struct {
+	bucket       string
+	key          string
+	deleteMarker bool
+	unresolved   bool // pack list not read so the blocks are unknown
+	pending      int  // blocks not yet cached
+	blocks       int
+	bytes        int64
+}
+
+// the part of the database the restore will walk
+type restoreModel struct {
+	plan       *TapePlan
+	versions   map[string]*modelVersion
+	keys       map[string][]string      // bucketkey to versions oldest to newest
+	packBlocks map[string][]*modelBlock // blocks of each pack ordered by offset
+	cached     int64                    // bytes already in the cache
+}
+
+type bucketEstimate struct {
+	Objects       int
+	DeleteMarkers int
+	Bytes         int64
+	Requests      int
+}
+
+type tapeEstimate struct {
+	Drive  int
+	Bytes  int64
+	Blocks int
+	Start  float64 // seconds from the start of the restore
+	End    float64
+}
+
+type restoreEstimate struct {
+	Tapes      map[string]*tapeEstimate
+	Buckets    map[string]*bucketEstimate
+	PeakCache  int64
+	EndCache   int64 // bytes left staged when the last tape is read
+	Seconds    float64
+	Unresolved int // versions whose pack lists have not been read
+	Stalled    int // versions that can not complete from the tapes planned
+}
+
+// build the model of the restore from the database
+func (dbm *DBManager) buildRestoreModel() *restoreModel {
+	model := &restoreModel{
+		plan:       dbm.PlanTapes(),
+		versions:   make(map[string]*modelVersion),
+		keys:       make(map[string][]string),
+		packBlocks: make(map[string][]*modelBlock),
+	}
+	dbm.lock()
+	defer dbm.unlock()
+	for _, versionID := range dbm.getAllVersionsNotCompleted() {
+		bucketkey, _, deleteMarker, ispacklist, blockids := dbm.getVersionInfo(versionID)
+		bucket, key := dbm.getBucketKey(bucketkey)
+		mv := &modelVersion{bucket: bucket, key: key, deleteMarker: deleteMarker}
+		if ispacklist && len(blockids) == 0 {
+			mv.unresolved = true
+		}
+		for _, blockid := range blockids {
+			state, entry := dbm.getBlockRecord(blockid)
+			mv.blocks++
+			if state == STATE_CACHED {
+				// use the size of the cached file when it exists
+				bytes := entry.GetPhysicalLength()
+				if info, err := os.Stat(dbm.cacheDir + "/" + bucket + "/" + blockid); err == nil {
+					bytes = info.Size()
+				}
+				mv.bytes += bytes
+				model.cached += bytes
+				continue
+			}
+			mv.pending++
+			mv.bytes += entry.GetPhysicalLength()
+			model.packBlocks[entry.GetPackName()] = append(model.packBlocks[entry.GetPackName()], &modelBlock{
+				pack:    entry.GetPackName(),
+				offset:  entry.GetPhysicalStart(),
+				bytes:   entry.GetPhysicalLength(),
+				version: versionID,
+			})
+		}
+		model.versions[versionID] = mv
+		// versions are returned oldest to newest
+		model.keys[bucketkey] = append(model.keys[bucketkey], versionID)
+	}
+	for _, blocks := range model.packBlocks {
+		sort.Slice(blocks, func(i, j int) bool {
+			return blocks[i].offset < blocks[j].offset
+		})
+	}
+	return model
+}
+
+// estimate the restore reading the tapes in the order given
+func (model *restoreModel) simulate(order []string, timing DriveTiming) *restoreEstimate {
+	estimate := &restoreEstimate{
+		Tapes:   make(map[string]*tapeEstimate),
+		Buckets: make(map[string]*bucketEstimate),
+	}
+	bytesPerSecond := timing.Throughput * 1000 * 1000
+	drives := timing.Drives
+	if drives < 1 {
+		drives = 1
+	}
+
+	// assign each tape to the drive that becomes free first, and record
+	// when each block will have been read
+	type blockEvent struct {
+		at    float64
+		block *modelBlock
+	}
+	var events []blockEvent
+	driveFree := make([]float64, drives)
+	for _, tape := range order {
+		drive := 0
+		for d := range driveFree {
+			if driveFree[d] < driveFree[drive] {
+				drive = d
+			}
+		}
+		te := &tapeEstimate{Drive: drive, Start: driveFree[drive]}
+		at := te.Start + timing.LoadSeconds + timing.MountSeconds
+		for _, pack := range model.plan.Packs[tape] {
+			for _, block := range model.packBlocks[pack] {
+				at += float64(block.bytes) / bytesPerSecond
+				te.Bytes += block.bytes
+				te.Blocks++
+				events = append(events, blockEvent{at: at, block: block})
+			}
+		}
+		te.End = at
+		driveFree[drive] = at
+		estimate.Tapes[tape] = te
+		if at > estimate.Seconds {
+			estimate.Seconds = at
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].at < events[j].at
+	})
+
+	// replay the block reads, a version is uploaded and its blocks leave the cache once
+	// all its blocks are cached and every older version of the key has been uploaded
+	pending := make(map[string]int)
+	for versionID, mv := range model.versions {
+		pending[versionID] = mv.pending
+	}
+	next := make(map[string]int)
+	cache := model.cached
+	estimate.PeakCache = cache
+	upload := func(bucketkey string) {
+		versions := model.keys[bucketkey]
+		for next[bucketkey] < len(versions) {
+			versionID := versions[next[bucketkey]]
+			mv := model.versions[versionID]
+			if !mv.deleteMarker && (mv.unresolved || pending[versionID] > 0) {
+				return
+			}
+			be, ok := estimate.Buckets[mv.bucket]
+			if !ok {
+				be = &bucketEstimate{}
+				estimate.Buckets[mv.bucket] = be
+			}
+			if mv.deleteMarker {
+				be.DeleteMarkers++
+				be.Requests++
+			} else {
+				be.Objects++
+				be.Bytes += mv.bytes
+				// more than one block is a multipart upload, create, one part per block and complete
+				if mv.blocks > 1 {
+					be.Requests += mv.blocks + 2
+				} else {
+					be.Requests++
+				}
+				cache -= mv.bytes
+			}
+			next[bucketkey]++
+		}
+	}
+	// versions already complete, such as data stored in the version record
+	for bucketkey := range model.keys {
+		upload(bucketkey)
+	}
+	for _, event := range events {
+		cache += event.block.bytes
+		if cache > estimate.PeakCache {
+			estimate.PeakCache = cache
+		}
+		pending[event.block.version]--
+		mv := model.versions[event.block.version]
+		upload(mv.bucket + "/" + mv.key)
+	}
+
+	estimate.EndCache = cache
+
+	// versions that will be left waiting at the end of the restore
+	for bucketkey, versions := range model.keys {
+		for _, versionID := range versions[next[bucketkey]:] {
+			if model.versions[versionID].unresolved {
+				estimate.Unresolved++
+			} else {
+				estimate.Stalled++
+			}
+		}
+	}
+	// each bucket is checked for and created
+	for _, be := range estimate.Buckets {
+		be.Requests += 2
+	}
+	return estimate
+}
+
+// print the plan and estimate for a restore without reading any data
+func (db *Database) DryRun() {
+	timing := db.timing
+	model := db.dbManager.buildRestoreModel()
+	order := model.plan.Tapes
+	if db.schedule == SCHEDULE_CACHE {
+		order, _ = model.scheduleCacheAware(timing)
+	}
+	estimate := model.simulate(order, timing)
+	db.logger.Event("Dry Run, drives: ", timing.Drives, " throughput MB/s: ", timing.Throughput, " load s: ", timing.LoadSeconds, " mount s: ", timing.MountSeconds, " schedule: ", db.schedule)
+
+	fmt.Fprintln(Console, "\nDRY RUN, no tapes are loaded and nothing is written to the target")
+	fmt.Fprintln(Console, "\nOrder\tTape\t\tDrive\t#Blocks\tBytes\t\tStart\t\tEnd")
+	var totalBytes int64
+	for i, tape := range order {
+		te := estimate.Tapes[tape]
+		fmt.Fprintf(Console, "%d\t%-16s%d\t%d\t%-16d%-16s%s\n", i+1, tape, te.Drive, te.Blocks, te.Bytes, formatSeconds(te.Start), formatSeconds(te.End))
+		db.logger.Event("Dry Run Tape: ", tape, " drive: ", te.Drive, " blocks: ", te.Blocks, " bytes: ", te.Bytes, " start: ", te.Start, " end: ", te.End)
+		totalBytes += te.Bytes
+	}
+
+	var buckets []string
+	for bucket := range estimate.Buckets {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	fmt.Fprintln(Console, "\nBucket\t\t\t#Objects\t#DeleteMarkers\tBytes\t\tS3 Requests")
+	objects, requests := 0, 0
+	for _, bucket := range buckets {
+		be := estimate.Buckets[bucket]
+		fmt.Fprintf(Console, "%-24s%-16d%-16d%-16d%d\n", bucket, be.Objects, be.DeleteMarkers, be.Bytes, be.Requests)
+		db.logger.Event("Dry Run Bucket: ", bucket, " objects: ", be.Objects, " delete markers: ", be.DeleteMarkers, " bytes: ", be.Bytes, " requests: ", be.Requests)
+		objects += be.Objects
+		requests += be.Requests
+	}
+
+	fmt.Fprintln(Console, "\nTapes: ", len(order), "  Bytes: ", totalBytes, "  Objects: ", objects, "  S3 Requests: ", requests)
+	fmt.Fprintln(Console, "Peak Cache Bytes: ", estimate.PeakCache)
+	fmt.Fprintln(Console, "Estimated Duration: ", formatSeconds(estimate.Seconds))
+	if estimate.Unresolved > 0 {
+		fmt.Fprintln(Console, "Versions with unread pack lists not included in the estimate: ", estimate.Unresolved)
+	}
+	if estimate.Stalled > 0 {
+		fmt.Fprintln(Console, "Versions that can not complete from the tapes in the database: ", estimate.Stalled)
+	}
+	db.logger.Event("Dry Run Totals, tapes: ", len(order), " bytes: ", totalBytes, " objects: ", objects, " requests: ", requests, " peak cache: ", estimate.PeakCache, " seconds: ", estimate.Seconds, " unresolved: ", estimate.Unresolved, " stalled: ", estimate.Stalled)
+	db.compareSchedules(model, timing)
+}
+
+// compare the estimates of the cache aware schedule and reading the tapes oldest pack
+// first, -benchmark compares them reading the simulated tapes
+func (db *Database) compareSchedules(model *restoreModel, timing DriveTiming) {
+	schedules := []string{SCHEDULE_OLDEST, SCHEDULE_CACHE}
+	cacheOrder, _ := model.scheduleCacheAware(timing)
+	orders := [][]string{model.plan.Tapes, cacheOrder}
+	fmt.Fprintln(Console, "\nSchedule\tPeak Cache\tStaged At End\tDuration")
+	for i, schedule := range schedules {
+		estimate := model.simulate(orders[i], timing)
+		fmt.Fprintf(Console, "%-16s%-16d%-16d%s\n", schedule, estimate.PeakCache, estimate.EndCache, formatSeconds(estimate.Seconds))
+		db.logger.Event("Dry Run Schedule: ", schedule, " order: ", orders[i], " peak cache: ", estimate.PeakCache, " end cache: ", estimate.EndCache, " seconds: ", estimate.Seconds)
+	}
+}
+
+func formatSeconds(seconds float64) string {
+	return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+}
@@ -0,0 +1,330 @@
+// writes restored objects to a directory tree for customers without an s3 system
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	. "ltfs-vof/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode/utf8"
+)
+
+const (
+	FS_METADATA_JSON  = "json"
+	FS_METADATA_XATTR = "xattr"
+	FS_METADATA_NONE  = "none"
+)
+
+// directories under the root that hold what is not the latest version of a key,
+// bucket names can not start with a dot so they never collide with a bucket
+const (
+	FS_VERSIONS_DIR  = ".versions"
+	FS_METADATA_DIR  = ".metadata"
+	FS_CONFLICTS_DIR = ".conflicts"
+	FS_TEMP_DIR      = ".tmp"
+)
+
+// the longest file name most file systems allow
+const FS_MAX_NAME = 255
+
+// the latest version of each object is written to <root>/<bucket>/<key>. Older versions
+// and delete markers are kept in <root>/.versions/<bucket>/<key>/<version id> if asked
+type FSTarget struct {
+	root         string
+	cacheDir     string
+	keepVersions bool
+	metadata     string
+	// the path and size of the latest version of each bucket/key written
+	mutex   sync.Mutex
+	written map[string]fsWritten
+	logger  *Logger
+}
+
+type fsWritten struct {
+	path string
+	size int64
+}
+
+func NewFSTarget(root, cacheDir string, keepVersions bool, metadata string, logger *Logger) *FSTarget {
+	if metadata != FS_METADATA_JSON && metadata != FS_METADATA_XATTR && metadata != FS_METADATA_NONE {
+		logger.Fatal("Unknown file system metadata: ", metadata, " use ", FS_METADATA_JSON, ", ", FS_METADATA_XATTR, " or ", FS_METADATA_NONE)
+	}
+	err := os.MkdirAll(filepath.Join(root, FS_TEMP_DIR), 0777)
+	if err != nil {
+		logger.Fatal("Unable to create file system target: ", root, err)
+	}
+	logger.Event("File system target: ", root, " keep versions: ", keepVersions, " metadata: ", metadata)
+	return &FSTarget{
+		root:         root,
+		cacheDir:     cacheDir,
+		keepVersions: keepVersions,
+		metadata:     metadata,
+		written:      make(map[string]fsWritten),
+		logger:       logger,
+	}
+}
+
+// the metadata written next to an object or in its extended attributes
+type fsMetadata struct {
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	VersionID    string `json:"versionId"`
+	DeleteMarker bool   `json:"deleteMarker,omitempty"`
+	*VersionMeta
+}
+
+// write the version as the latest object of the key, the data is written to a temporary
+// file first so a reader never sees a partial object
+func (t *FSTarget) PutVersion(bucket, key, versionID string, blockFiles []string, meta *VersionMeta) *TargetResult {
+	temp, err := os.CreateTemp(filepath.Join(t.root, FS_TEMP_DIR), versionID+"-")
+	if err != nil {
+		t.logger.Fatal("Unable to create file for object: ", bucket, "/", key, err)
+	}
+	var size int64
+	hash := md5.New()
+	for _, blockFile := range blockFiles {
+		f, err := os.Open(t.cacheDir + "/" + bucket + "/" + blockFile)
+		if err != nil {
+			t.logger.Fatal("Unable to open block: ", blockFile, " for object: ", bucket, "/", key, err)
+		}
+		n, err := io.Copy(io.MultiWriter(temp, hash), f)
+		size += n
+		f.Close()
+		if err != nil {
+			t.logger.Fatal("Unable to write block: ", blockFile, " for object: ", bucket, "/", key, err)
+		}
+	}
+	err = temp.Close()
+	if err != nil {
+		t.logger.Fatal("Unable to write object: ", bucket, "/", key, err)
+	}
+	record := &fsMetadata{Bucket: bucket, Key: key, VersionID: versionID, VersionMeta: meta}
+	modTime := meta.ModTime(versionID, t.logger)
+	sidecars := t.metadata == FS_METADATA_JSON
+	if t.metadata == FS_METADATA_XATTR && !t.setXattrs(temp.Name(), record) {
+		sidecars = true
+	}
+	// keep a link to every version so the next version can replace the latest
+	if t.keepVersions {
+		versionPath := t.versionPath(bucket, key, versionID)
+		t.mkdir(filepath.Dir(versionPath))
+		os.Remove(versionPath)
+		err = os.Link(temp.Name(), versionPath)
+		if err != nil {
+			t.logger.Fatal("Unable to keep version: ", versionID, " of: ", bucket, "/", key, err)
+		}
+		if sidecars {
+			t.writeJSON(versionPath+".json", record)
+		}
+	}
+
+	path, sidecar := t.latestPath(bucket, key)
+	if !t.place(temp.Name(), path) {
+		// a key that is also the prefix of another key can not be both a file and a directory
+		path, sidecar = t.conflictPath(bucket, key)
+		t.logger.Event("File system, object and directory have the same name: ", bucket, "/", key, " written to: ", path)
+		if !t.place(temp.Name(), path) {
+			t.logger.Fatal("Unable to write object: ", bucket, "/", key, " to: ", path)
+		}
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.logger.Event("Unable to set modified time of: ", path, err)
+	}
+	if sidecars {
+		t.writeJSON(sidecar, record)
+	}
+	t.mutex.Lock()
+	t.written[bucket+"/"+key] = fsWritten{path: path, size: size}
+	t.mutex.Unlock()
+	t.logger.Event("File system, wrote bucket: ", bucket, " key: ", key, " version: ", versionID, " to: ", path)
+	return &TargetResult{ETag: hex.EncodeToString(hash.Sum(nil))}
+}
+
+// a delete marker removes the latest object, the older versions are kept
+func (t *FSTarget) DeleteMarker(bucket, key, versionID string, meta *VersionMeta) *TargetResult {
+	path, sidecar := t.latestPath(bucket, key)
+	conflict, conflictSidecar := t.conflictPath(bucket, key)
+	for _, name := range []string{path, sidecar, conflict, conflictSidecar} {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			t.logger.Event("File system, unable to remove: ", name, err)
+		}
+	}
+	if t.keepVersions {
+		markerPath := t.versionPath(bucket, key, versionID) + ".deletemarker"
+		t.mkdir(filepath.Dir(markerPath))
+		err := os.WriteFile(markerPath, nil, 0666)
+		if err != nil {
+			t.logger.Fatal("Unable to write delete marker: ", markerPath, err)
+		}
+		modTime := meta.ModTime(versionID, t.logger)
+		os.Chtimes(markerPath, modTime, modTime)
+		if t.metadata != FS_METADATA_NONE {
+			t.writeJSON(markerPath+".json", &fsMetadata{Bucket: bucket, Key: key, VersionID: versionID, DeleteMarker: true, VersionMeta: meta})
+		}
+	}
+	t.mutex.Lock()
+	delete(t.written, bucket+"/"+key)
+	t.mutex.Unlock()
+	t.logger.Event("File system, delete marker bucket: ", bucket, " key: ", key, " version: ", versionID)
+	return &TargetResult{}
+}
+
+func (t *FSTarget) EnsureBucket(bucket, key string) {
+	t.mkdir(filepath.Join(t.root, bucket))
+}
+
+// check the latest version of each key written is in the tree with its size
+func (t *FSTarget) Verify() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ok := true
+	for bucketkey, written := range t.written {
+		info, err := os.Stat(written.path)
+		if err != nil {
+			t.logger.Event("File system verify, missing: ", bucketkey, " at: ", written.path, err)
+			ok = false
+		} else if info.Size() != written.size {
+			t.logger.Event("File system verify, size mismatch: ", bucketkey, " at: ", written.path, " size: ", info.Size(), " expected: ", written.size)
+			ok = false
+		}
+	}
+	t.logger.Event("File system verify, objects: ", len(t.written), " ok: ", ok)
+	return ok
+}
+
+func (t *FSTarget) Close() {}
+
+// returns the path of the latest object and of its json sidecar
+func (t *FSTarget) latestPath(bucket, key string) (string, string) {
+	relative := fsKeyPath(key)
+	return filepath.Join(t.root, bucket, relative), filepath.Join(t.root, FS_METADATA_DIR, bucket, relative) + ".json"
+}
+
+func (t *FSTarget) versionPath(bucket, key, versionID string) string {
+	return filepath.Join(t.root, FS_VERSIONS_DIR, bucket, fsKeyPath(key), versionID)
+}
+
+// objects that can not be written at their key are named by the hash of the key
+func (t *FSTarget) conflictPath(bucket, key string) (string, string) {
+	sum := sha256.Sum256([]byte(key))
+	path := filepath.Join(t.root, FS_CONFLICTS_DIR, bucket, hex.EncodeToString(sum[:]))
+	return path, path + ".json"
+}
+
+// move the temporary file to the path, false if a file or directory is in the way
+func (t *FSTarget) place(temp, path string) bool {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		return false
+	}
+	err = os.Rename(temp, path)
+	return err == nil
+}
+
+func (t *FSTarget) mkdir(dir string) {
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		t.logger.Fatal("Unable to create directory: ", dir, err)
+	}
+}
+
+func (t *FSTarget) writeJSON(path string, record *fsMetadata) {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		t.logger.Fatal("Unable to marshal metadata for: ", record.Bucket, "/", record.Key, err)
+	}
+	t.mkdir(filepath.Dir(path))
+	err = os.WriteFile(path, data, 0666)
+	if err != nil {
+		t.logger.Fatal("Unable to write metadata: ", path, err)
+	}
+}
+
+// metadata is written to the user namespace, false if the file system does not support
+// extended attributes and a json sidecar is needed instead
+func (t *FSTarget) setXattrs(path string, record *fsMetadata) bool {
+	for name, value := range record.attributes() {
+		err := syscall.Setxattr(path, name, []byte(value), 0)
+		if err != nil {
+			t.logger.Event("Unable to set extended attribute: ", name, " on: ", path, " ", err, ", using a json sidecar")
+			return false
+		}
+	}
+	return true
+}
+
+// the extended attribute names and values that carry the metadata of a version
+func (record *fsMetadata) attributes() map[string]string {
+	attrs := map[string]string{
+		"user.s3.bucket":     record.Bucket,
+		"user.s3.key":        record.Key,
+		"user.s3.version-id": record.VersionID,
+	}
+	if record.VersionMeta != nil {
+		if record.ETag != "" {
+			attrs["user.s3.etag"] = record.ETag
+		}
+		for name, value := range record.Metadata {
+			attrs["user.s3.meta."+strings.ToLower(name)] = value
+		}
+		for name, value := range record.UserMetadata {
+			attrs["user.s3.user."+strings.ToLower(name)] = value
+		}
+		for name, value := range record.Tags {
+			attrs["user.s3.tag."+name] = value
+		}
+	}
+	return attrs
+}
+
+// keys are split on / into directories. Segments that are not valid file names, . or ..
+// or with a NUL, are percent encoded along with any % so the mapping can be reversed, an
+// empty segment is a lone % which no encoded segment is. Segments that are too long are
+// cut between characters and escapes and end with the hash of the segment
+func fsKeyPath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = fsSegment(segment)
+	}
+	return filepath.Join(segments...)
+}
+
+func fsSegment(segment string) string {
+	switch segment {
+	case "":
+		return "%"
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	}
+	var b strings.Builder
+	for i := 0; i < len(segment); i++ {
+		c := segment[i]
+		if c == '%' || c < 0x20 || c == 0x7f {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	name := b.String()
+	if len(name) > FS_MAX_NAME {
+		cut := FS_MAX_NAME - 17
+		for cut > 0 && (!utf8.RuneStart(name[cut]) || strings.LastIndexByte(name[:cut], '%') >= cut-2) {
+			cut--
+		}
+		sum := sha256.Sum256([]byte(segment))
+		name = name[:cut] + "~" + hex.EncodeToString(sum[:8])
+	}
+	return name
+}
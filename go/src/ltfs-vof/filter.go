@@ -0,0 +1,137 @@
+// selects the versions that are restored or put into the database
+package main
+
+import (
+	"bufio"
+	"github.com/oklog/ulid/v2"
+	. "ltfs-vof/utils"
+	"os"
+	"strings"
+	"time"
+)
+
+// an empty filter matches every version
+type RestoreFilter struct {
+	buckets  map[string]bool
+	prefixes []string
+	keys     map[string]bool
+	after    time.Time
+	before   time.Time
+	versions map[string]bool
+}
+
+// buckets and prefixes can be repeated, the key file has one bucket/key per line
+// and after and before are RFC3339 times that bound the version creation time
+func NewRestoreFilter(buckets, prefixes []string, keyFile, after, before string, logger *Logger) *RestoreFilter {
+	var filter RestoreFilter
+	if len(buckets) > 0 {
+		filter.buckets = make(map[string]bool)
+		for _, bucket := range buckets {
+			filter.buckets[bucket] = true
+		}
+	}
+	filter.prefixes = prefixes
+
+	// read the key list, skipping blank lines
+	if keyFile != "" {
+		file, err := os.Open(keyFile)
+		if err != nil {
+			logger.Fatal("Unable to open key list file: ", keyFile, " ", err)
+		}
+		defer file.Close()
+		filter.keys = make(map[string]bool)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			if !strings.Contains(line, "/") {
+				logger.Fatal("Key list entries must be bucket/key: ", line)
+			}
+			filter.keys[line] = true
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Fatal("Unable to read key list file: ", keyFile, " ", err)
+		}
+	}
+	filter.after = parseFilterTime(after, logger)
+	filter.before = parseFilterTime(before, logger)
+	return &filter
+}
+
+func parseFilterTime(value string, logger *Logger) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		logger.Fatal("Unable to parse time, use RFC3339 e.g. 2024-01-02T15:04:05Z: ", value)
+	}
+	return t
+}
+
+// true if the filter selects every version
+func (f *RestoreFilter) IsEmpty() bool {
+	return f == nil || (f.buckets == nil && len(f.prefixes) == 0 && f.keys == nil && f.after.IsZero() && f.before.IsZero() && f.versions == nil)
+}
+
+// restrict the filter to an explicit set of version ids
+func (f *RestoreFilter) SelectVersions(versions map[string]bool) {
+	f.versions = versions
+}
+
+// true if the version of the bucket and key is selected, the creation time
+// of the version is taken from its ULID
+func (f *RestoreFilter) Match(bucket, key, versionID string) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	if f.buckets != nil && !f.buckets[bucket] {
+		return false
+	}
+	if len(f.prefixes) > 0 {
+		found := false
+		for _, prefix := range f.prefixes {
+			if strings.HasPrefix(key, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.keys != nil && !f.keys[bucket+"/"+key] {
+		return false
+	}
+	if f.versions != nil && !f.versions[versionID] {
+		return false
+	}
+	if !f.after.IsZero() || !f.before.IsZero() {
+		id, err := ulid.Parse(versionID)
+		if err != nil {
+			return false
+		}
+		created := time.UnixMilli(int64(id.Time()))
+		if !f.after.IsZero() && created.Before(f.after) {
+			return false
+		}
+		if !f.before.IsZero() && !created.Before(f.before) {
+			return false
+		}
+	}
+	return true
+}
+
+// same as Match but takes the bucketkey stored in the versions table
+func (f *RestoreFilter) MatchBucketKey(bucketkey, versionID string) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	segments := strings.SplitN(bucketkey, "/", 2)
+	if len(segments) != 2 {
+		return false
+	}
+	return f.Match(segments[0], segments[1], versionID)
+}
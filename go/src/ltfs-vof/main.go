@@ -8,13 +8,32 @@ import (
 	"io/ioutil"
 	. "ltfs-vof/tapehardware"
 	. "ltfs-vof/utils"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // the format of the json config file
 type Config struct {
 	LibraryDevice    string                   `json:"LibraryDevice"`
 	TapeDriveDevices map[int]*TapeDriveDevice `json:"TapeDevices"`
+	// drive performance used to estimate a dry run
+	DriveThroughput float64 `json:"DriveThroughputMBs"`
+	LoadSeconds     float64 `json:"LoadSeconds"`
+	MountSeconds    float64 `json:"MountSeconds"`
+	// retries of library moves, mounts and pack reads
+	RetryAttempts       int     `json:"RetryAttempts"`
+	RetryBackoffSeconds float64 `json:"RetryBackoffSeconds"`
+	RetryOnOtherDrive   bool    `json:"RetryOnOtherDrive"`
+	// versions uploaded in parallel and the versions queued before tape reading waits
+	UploadWorkers    int `json:"UploadWorkers"`
+	UploadQueueDepth int `json:"UploadQueueDepth"`
+	// size of the block cache before tape reading waits for uploads, zero is no limit
+	CacheQuotaGB float64 `json:"CacheQuotaGB"`
+	// where restored versions are written, the command line can override it
+	Target TargetConfig `json:"Target"`
 }
 
 const DEFAULT_DB string = "./db"
@@ -23,6 +42,18 @@ const DEFAULT_VERSION_CACHE string = "versions"
 const DEFAULT_REGION string = "us-east-1"
 const DEFAULT_CONFIG_FILE string = "config.json"
 const DEFAULT_LOG_FILE string = "ltfs-vof.log"
+const DEFAULT_DRIVE_THROUGHPUT float64 = 300
+const DEFAULT_LOAD_SECONDS float64 = 90
+const DEFAULT_MOUNT_SECONDS float64 = 60
+const DEFAULT_RETRY_ATTEMPTS int = 3
+const DEFAULT_RETRY_BACKOFF_SECONDS float64 = 10
+const DEFAULT_PROGRESS_SECONDS int = 30
+const DEFAULT_STATUS_FILE string = "status.json"
+const DEFAULT_UPLOAD_WORKERS int = 4
+const DEFAULT_UPLOAD_QUEUE_DEPTH int = 64
+const DEFAULT_VERIFY_REPORT string = "verify.jsonl"
+const DEFAULT_MANIFEST string = "manifest.jsonl"
+const VERIFY_SUFFIX string = "-verify"
 
 func main() {
 	// get the command line arguments
@@ -31,12 +62,50 @@ func main() {
 	database := flag.Bool("database", false, "Create the database")
 	read := flag.Bool("read", false, "Read the tapes")
 	clean := flag.Bool("clean", false, "Clean the log and database file")
-	region := flag.String("region", DEFAULT_REGION, "region or endpoint to write s3 objects")
+	region := flag.String("region", "", "region to write s3 objects, default from the config file or us-east-1")
+	endpoint := flag.String("endpoint", "", "URL of an S3 compatible service to write s3 objects to instead of AWS")
+	pathStyle := flag.Bool("path-style", false, "With -endpoint address buckets as URL/bucket")
+	caBundle := flag.String("ca-bundle", "", "PEM file of the certificate authorities that signed the S3 service certificate")
+	insecure := flag.Bool("insecure", false, "Do not check the S3 service certificate")
+	profile := flag.String("profile", "", "Named profile in the shared AWS credentials and config files")
 	configFile := flag.String("config", DEFAULT_CONFIG_FILE, "JSON file that defines tape drive mapping")
 	logFile := flag.String("log", DEFAULT_LOG_FILE, "Log file for this run")
 	versioned := flag.Bool("versioning", true, "set to false if customer buckets are non versioned")
 	s3 := flag.Bool("s3", false, "Write objects to S3 buckets ")
-	compare := flag.Bool("compare", false, "Compare simulation and customer buckets")
+	remapFile := flag.String("remap", "", "JSON rules file that restores S3 objects to other buckets and keys")
+	targetType := flag.String("target", "", "Where to write objects: s3, filesystem, tar or null, default from the config file")
+	fsRoot := flag.String("fs-root", "", "Write objects to a directory tree at this path instead of S3")
+	fsVersions := flag.Bool("fs-versions", false, "With -fs-root keep older versions and delete markers under .versions")
+	fsMetadata := flag.String("fs-metadata", "", "With -fs-root write metadata as json sidecars, xattr or none, default json")
+	tarPath := flag.String("tar", "", "Write objects to tar files with this name, a named pipe or - for stdout")
+	tarSize := flag.Float64("tar-size", 0, "With -tar start a new tar file after this many GB, default one file")
+	manifest := flag.String("manifest", DEFAULT_MANIFEST, "JSON lines file recording the source and target of each version restored, empty for none")
+	verifyOnly := flag.Bool("verify-only", false, "With -read read every pack and check every TLV and version without writing to a target")
+	verifyReport := flag.String("verify-report", DEFAULT_VERIFY_REPORT, "JSON lines file with the result of each version checked by -verify-only")
+	compare := flag.Bool("compare", false, "Compare simulation and customer buckets, or check the files written to a filesystem or tar target")
+	report := flag.Bool("report", false, "Report versions that have not been restored and the tapes they need")
+	// filter options used when building the database and reading
+	var filterBuckets stringSlice
+	flag.Var(&filterBuckets, "bucket", "only restore this bucket, may be repeated")
+	var filterPrefixes stringSlice
+	flag.Var(&filterPrefixes, "prefix", "only restore keys with this prefix, may be repeated")
+	filterKeys := flag.String("keys", "", "file listing the bucket/key of each object to restore, one per line")
+	filterAfter := flag.String("after", "", "only restore versions created at or after this RFC3339 time")
+	filterBefore := flag.String("before", "", "only restore versions created before this RFC3339 time")
+	asOf := flag.String("as-of", "", "restore each key as it existed at this RFC3339 time")
+	latest := flag.Bool("latest", false, "only restore the live version of each key, for non versioned buckets")
+	plan := flag.Bool("plan", false, "List the tapes needed for the restore, the bytes to read and the load order")
+	dryRun := flag.Bool("dry-run", false, "With -read estimate the restore without loading tapes or writing to the target")
+	preflight := flag.Bool("preflight", false, "Check every tape the restore needs is in the library")
+	allowMissing := flag.Bool("allow-missing", false, "Restore from the tapes available when some are not in the library")
+	prescan := flag.Bool("prescan", false, "Read only the pack lists on the tapes before the data so every block is known")
+	schedule := flag.String("schedule", SCHEDULE_OLDEST, "Tape read order, oldest reads the oldest packs first, cache keeps the least data staged and gives each tape a drive")
+	benchmark := flag.Bool("benchmark", false, "With -simulate read the tapes once with each schedule on copies of the catalog and compare the cache and time they need")
+	progressSeconds := flag.Int("progress", DEFAULT_PROGRESS_SECONDS, "Seconds between progress reports while reading, 0 for none")
+	statusFile := flag.String("status-file", DEFAULT_STATUS_FILE, "JSON file the progress of a read is written to")
+	metrics := flag.String("metrics", "", "Address to serve Prometheus metrics on, e.g. :9100")
+	lookup := flag.String("lookup", "", "Show the target version restored from an original version ID, or the original of a target version ID")
+	status := flag.Bool("status", false, "Show the cache usage, pinned bytes and oldest version waiting to be uploaded")
 	// simulation options
 	simulate := flag.Bool("simulate", false, "Simulate a tape library ")
 	simTapes := flag.Int("simtapes", 0, "Create the number of simulated tapes specified")
@@ -51,6 +120,15 @@ func main() {
 
 	// create the customer logger
 	logger := NewLogger(*logFile, *clean)
+	if *dryRun && !*read {
+		logger.Fatal("-dry-run requires -read")
+	}
+	if *asOf != "" && *latest {
+		logger.Fatal("Only one of -as-of and -latest can be used")
+	}
+	if *metrics != "" {
+		StartMetrics(*metrics, logger)
+	}
 
 	// if create simulated tapes then do it and exit
 	if *simTapes != 0 {
@@ -72,18 +150,95 @@ func main() {
 		logger.Fatal("Unable to json unmarshal the json config file: ", *configFile)
 	}
 
+	// the target from the config file unless the command line names one, nothing is
+	// written without a target
+	targetConfig := config.Target
+	if *targetType != "" {
+		targetConfig.Type = *targetType
+	}
+	targetFlags := 0
+	if *s3 {
+		targetConfig.Type = TARGET_S3
+		targetFlags++
+	}
+	if *fsRoot != "" {
+		targetConfig.Type = TARGET_FS
+		targetConfig.Path = *fsRoot
+		targetFlags++
+	}
+	if *tarPath != "" {
+		targetConfig.Type = TARGET_TAR
+		targetConfig.Path = *tarPath
+		targetFlags++
+	}
+	if targetFlags > 1 {
+		logger.Fatal("Only one of -s3, -fs-root and -tar can be used")
+	}
+	if *fsVersions {
+		targetConfig.KeepVersions = true
+	}
+	if *fsMetadata != "" {
+		targetConfig.Metadata = *fsMetadata
+	}
+	if *tarSize != 0 {
+		targetConfig.TarSizeGB = *tarSize
+	}
+	if *remapFile != "" {
+		targetConfig.RemapFile = *remapFile
+	}
+	if targetConfig.RemapFile != "" && targetConfig.Type != TARGET_S3 {
+		logger.Fatal("Remap rules only apply to the s3 target")
+	}
+	if targetConfig.Type == "" || *dryRun {
+		targetConfig.Type = TARGET_NULL
+	}
+	// the command line sets the default endpoint, buckets set in the config file keep
+	// the settings they give
+	if *region != "" {
+		targetConfig.S3.Region = *region
+	}
+	if *endpoint != "" {
+		targetConfig.S3.URL = *endpoint
+	}
+	if *pathStyle {
+		targetConfig.S3.PathStyle = true
+	}
+	if *caBundle != "" {
+		targetConfig.S3.CABundle = *caBundle
+	}
+	if *insecure {
+		targetConfig.S3.Insecure = true
+	}
+	if *profile != "" {
+		targetConfig.S3.Profile = *profile
+	}
+	targetConfig.Versioning = *versioned
+	targetConfig.Simulation = *simulate
+	// the tar is the only thing written to stdout when it is streamed there
+	if targetConfig.Type == TARGET_TAR && targetConfig.Path == "-" {
+		Console = os.Stderr
+	}
+	// the null target keeps nothing and a tar streamed to stdout can't be read back,
+	// there is nothing to compare
+	if *compare && targetConfig.Type == TARGET_NULL && !*verifyOnly {
+		logger.Fatal("-compare needs a target, the null target keeps nothing to compare")
+	}
+	if *compare && targetConfig.Type == TARGET_TAR && targetConfig.Path == "-" {
+		logger.Fatal("-compare can not read back a tar written to stdout")
+	}
+
 	// run a verification of the config file
 	if *verify {
 		library := NewRealTapeLibrary(config.LibraryDevice, config.TapeDriveDevices)
-		fmt.Println("\n\nLibrary: ", config.LibraryDevice)
+		fmt.Fprintln(Console, "\n\nLibrary: ", config.LibraryDevice)
 		tapeDrives, tapeCartridges := library.Audit()
 
-		fmt.Println("\nCartridge\tSlot")
+		fmt.Fprintln(Console, "\nCartridge\tSlot")
 		for _, tc := range tapeCartridges {
-			fmt.Printf("%.18s%d\n", tc.Name(), tc.GetSlot())
+			fmt.Fprintf(Console, "%.18s%d\n", tc.Name(), tc.GetSlot())
 		}
 		// check that tape drives the
-		fmt.Println("\nDrive\tSerial\t\tCart")
+		fmt.Fprintln(Console, "\nDrive\tSerial\t\tCart")
 		drivePathFailure := false
 		for d, td := range tapeDrives {
 			// if does not exist on data path then exit
@@ -95,9 +250,9 @@ func main() {
 			}
 			cart, _ := td.GetCart()
 			if cart != nil {
-				fmt.Printf("%02d%16s%16s\n", d, sn, cart.Name())
+				fmt.Fprintf(Console, "%02d%16s%16s\n", d, sn, cart.Name())
 			} else {
-				fmt.Printf("%02d%16s%16s\n", d, sn, "No Cartridge")
+				fmt.Fprintf(Console, "%02d%16s%16s\n", d, sn, "No Cartridge")
 			}
 		}
 		if drivePathFailure {
@@ -109,15 +264,91 @@ func main() {
 	logger.Event("****RUN PARMS **** ")
 	logger.Event("\n\tSIMULATE: ", *simulate, "\n\tVERSION: ", *version, "\n\tDATABASE: ", *database, "\n\tREAD: ", *read, "\n\tS3: ", *simS3)
 
-	// select the library type used
+	// select the library type used, a dry run does not touch the library or the target
 	var library TapeLibrary
-	if *simulate {
-		library = NewTapeLibrarySimulator(SIMULATION_FILES, *simDrives, logger)
+	if *version || *preflight || *prescan || *benchmark || (*read && !*dryRun) {
+		if *simulate {
+			library = NewTapeLibrarySimulator(SIMULATION_FILES, *simDrives, logger)
+		} else {
+			library = NewRealTapeLibrary(config.LibraryDevice, config.TapeDriveDevices)
+		}
+	}
+
+	dbName, cacheDir := DEFAULT_DB, DEFAULT_BLOCK_CACHE
+	var verifier *VerifyTarget
+	var target Target
+	if *verifyOnly && *read && !*dryRun {
+		// nothing is written, the versions are checked on a copy of the catalog
+		if targetFlags > 0 {
+			logger.Fatal("-verify-only does not write to a target")
+		}
+		dbName, cacheDir = copyCatalog(DEFAULT_DB, DEFAULT_BLOCK_CACHE, VERIFY_SUFFIX, logger)
+		verifier = NewVerifyTarget(*verifyReport, cacheDir, logger)
+		target = verifier
 	} else {
-		library = NewRealTapeLibrary(config.LibraryDevice, config.TapeDriveDevices)
+		target = NewTarget(targetConfig, DEFAULT_BLOCK_CACHE, logger)
+	}
+	dbManager := NewDBManager(dbName, cacheDir, *clean, target, logger)
+	filter := NewRestoreFilter(filterBuckets.Slice(), filterPrefixes.Slice(), *filterKeys, *filterAfter, *filterBefore, logger)
+	if !filter.IsEmpty() {
+		logger.Event("Restore Filter, buckets: ", filterBuckets.Slice(), " prefixes: ", filterPrefixes.Slice(), " keys: ", *filterKeys, " after: ", *filterAfter, " before: ", *filterBefore)
+	}
+	dbManager.SetFilter(filter)
+	// the manifest stays open across the prescan and the read
+	var manifestFile *Manifest
+	if *read && !*dryRun && verifier == nil && *manifest != "" {
+		manifestFile = NewManifest(*manifest, logger)
+		dbManager.SetManifest(manifestFile)
 	}
-	dbManager := NewDBManager(DEFAULT_DB, DEFAULT_BLOCK_CACHE, *region, *clean, *s3, *versioned, *simulate, logger)
 	db := NewDatabase(DEFAULT_VERSION_CACHE, dbManager, library, logger)
+	if verifier != nil {
+		db.SetVerifier(verifier)
+	}
+	retry := RetryPolicy{
+		Attempts:    config.RetryAttempts,
+		Backoff:     time.Duration(config.RetryBackoffSeconds * float64(time.Second)),
+		SwitchDrive: config.RetryOnOtherDrive,
+	}
+	if retry.Attempts == 0 {
+		retry.Attempts = DEFAULT_RETRY_ATTEMPTS
+	}
+	if config.RetryBackoffSeconds == 0 {
+		retry.Backoff = time.Duration(DEFAULT_RETRY_BACKOFF_SECONDS * float64(time.Second))
+	}
+	db.SetRetryPolicy(retry)
+	if config.UploadWorkers == 0 {
+		config.UploadWorkers = DEFAULT_UPLOAD_WORKERS
+	}
+	if config.UploadQueueDepth == 0 {
+		config.UploadQueueDepth = DEFAULT_UPLOAD_QUEUE_DEPTH
+	}
+	dbManager.SetUploadPool(config.UploadWorkers, config.UploadQueueDepth)
+	dbManager.SetCacheQuota(int64(config.CacheQuotaGB * 1000 * 1000 * 1000))
+
+	// drive performance used to schedule the tapes and estimate a dry run
+	timing := DriveTiming{
+		Drives:       len(config.TapeDriveDevices),
+		Throughput:   config.DriveThroughput,
+		LoadSeconds:  config.LoadSeconds,
+		MountSeconds: config.MountSeconds,
+	}
+	if *simulate {
+		timing.Drives = *simDrives
+	}
+	if timing.Throughput == 0 {
+		timing.Throughput = DEFAULT_DRIVE_THROUGHPUT
+	}
+	if timing.LoadSeconds == 0 {
+		timing.LoadSeconds = DEFAULT_LOAD_SECONDS
+	}
+	if timing.MountSeconds == 0 {
+		timing.MountSeconds = DEFAULT_MOUNT_SECONDS
+	}
+	if *schedule != SCHEDULE_CACHE && *schedule != SCHEDULE_OLDEST {
+		logger.Fatal("Unknown schedule: ", *schedule, " use ", SCHEDULE_CACHE, " or ", SCHEDULE_OLDEST)
+	}
+	db.SetSchedule(*schedule, timing)
+	db.SetProgress(*statusFile, time.Duration(*progressSeconds)*time.Second)
 	// if version is enabled create the database manager and get the version files
 	if *version {
 		logger.Event("*****COPYING VERSION FILES******")
@@ -130,22 +361,184 @@ func main() {
 		logger.Event("******ENDING BUILDING DATABASE*******")
 	}
 
+	// narrow the restore to the current versions of each key if specified
+	if *read || *plan {
+		// select the version of each key that was current at the time given
+		if *asOf != "" {
+			asOfTime := parseFilterTime(*asOf, logger)
+			count := dbManager.SelectVersionsAsOf(asOfTime)
+			logger.Event("As of: ", asOfTime, " restoring #versions: ", count)
+			fmt.Fprintln(Console, "Restoring ", count, " objects as of ", asOfTime)
+		} else if *latest {
+			count := dbManager.SelectLatestVersions()
+			logger.Event("Latest versions only, restoring #versions: ", count)
+			fmt.Fprintln(Console, "Restoring the latest version of ", count, " objects")
+		} else if !*versioned {
+			logger.Event("Buckets are not versioned, -latest avoids reading and uploading superseded versions")
+		}
+	}
+
+	// read the pack lists first so the plan and the read know every block
+	if *prescan && !*dryRun {
+		logger.Event("******PRESCANNING PACK LISTS*******")
+		stopSignals := handleSignals(db.control, logger)
+		db.Prescan()
+		stopSignals()
+		// the read writes to the target too, it is closed once the read is done
+		if !*read {
+			target.Close()
+		}
+	}
+
+	// print the tapes needed for the restore
+	if *plan {
+		logger.Event("******PLANNING TAPES*******")
+		db.PrintPlan()
+	}
+
+	// estimate the restore without reading any data
+	if *read && *dryRun {
+		logger.Event("******DRY RUN*******")
+		db.DryRun()
+		return
+	}
+
+	// check the library holds every tape needed without reading, missing tapes fail
+	// the check even when the restore would be allowed to continue without them
+	if *preflight && !*read {
+		logger.Event("******PREFLIGHT*******")
+		_, tapes := library.Audit()
+		order, _ := db.TapeOrder(timing)
+		available, _ := db.Preflight(order, tapes, *allowMissing)
+		if len(available) < len(order) {
+			logger.Fatal("Preflight failed, ", len(order)-len(available), " of ", len(order), " tapes needed are not in the library")
+		}
+		fmt.Fprintln(Console, "All ", len(order), " tapes needed are in the library")
+	}
+
+	// check the remap rules send every key to its own valid bucket and key
+	if customer, ok := target.(*S3Customer); ok && customer.remap != nil && (*read || *preflight) {
+		if !db.CheckRemap(customer.remap) {
+			logger.Fatal("Restore not started, the remap rules have problems")
+		}
+	}
+
+	// compare the schedules reading the simulated tapes, nothing is written to the target
+	if *benchmark {
+		if !*simulate {
+			logger.Fatal("-benchmark reads every tape once for each schedule, it only runs with -simulate")
+		}
+		logger.Event("******BENCHMARKING SCHEDULES*******")
+		db.BenchmarkSchedules(dbName, cacheDir, []string{SCHEDULE_OLDEST, SCHEDULE_CACHE}, *allowMissing)
+		return
+	}
+
+	// a read that continues a stopped or failed run keeps the buckets it wrote to
+	if customer, ok := target.(*S3Customer); ok && *read && dbManager.HasReadTapes() {
+		logger.Event("Continuing a restore, existing buckets are not cleaned out")
+		customer.KeepBuckets()
+	}
+
 	// restore all the content if specified
 	if *read {
 		logger.Event("******READING BLOCK FILES*******")
-		db.RestoreAll()
+		stopSignals := handleSignals(db.control, logger)
+		restored := db.RestoreAll(*allowMissing)
+		stopSignals()
+		if manifestFile != nil {
+			manifestFile.Close()
+		}
+		target.Close()
+		if !restored {
+			logger.Fatal("Restore not started, tapes are missing from the library")
+		}
+		// the tapes have been unloaded and the uploads finished, close the catalog and exit
+		if db.control.Stopping() {
+			dbManager.Close()
+			fmt.Fprintln(Console, "Restore stopped, run -read again to continue")
+			logger.Fatal("Restore stopped by signal")
+		}
 		logger.Event("******READ ALL BLOCK FILES*******")
+		if verifier != nil {
+			failedTapes := db.ReportFailedTapes()
+			if !verifier.Finish(dbManager.GetIncompleteVersions()) || failedTapes > 0 {
+				logger.Fatal("Verify failed, the tapes can not rebuild every version")
+			}
+			fmt.Fprintln(Console, "Verify passed, every version was rebuilt from the tapes")
+			return
+		}
+		// report any versions that never had all of their blocks read
+		incomplete := db.ReportIncomplete()
+		if failed := db.ReportFailedTapes(); failed > 0 {
+			logger.Fatal("Restore finished with ", failed, " failed tapes and ", incomplete, " incomplete versions")
+		}
+		if incomplete > 0 {
+			logger.Fatal("Restore finished with ", incomplete, " incomplete versions")
+		}
+	} else if *lookup != "" {
+		db.PrintVersionLookup(*lookup)
+	} else if *status {
+		db.PrintCacheStatus()
+	} else if *report {
+		logger.Event("******REPORTING INCOMPLETE VERSIONS*******")
+		db.ReportIncomplete()
+		db.ReportFailedTapes()
 	}
-	// if compare set then compare the simulated and customer buckets
+	// if compare set then compare the simulated and customer buckets, other targets
+	// check what was written to them
 	if *compare {
-		logger.Event("******COMPARING SIMULATED AND CUSTOMER BUCKETS*******")
-		if dbManager.Compare() {
-			fmt.Println("******SIMULATION AND CUSTOMER BUCKETS ARE THE SAME*******")
-			logger.Event("******SIMULATION AND CUSTOMER BUCKETS ARE THE SAME*******")
+		if _, ok := target.(*S3Customer); ok {
+			logger.Event("******COMPARING SIMULATED AND CUSTOMER BUCKETS*******")
+			if dbManager.VerifyTarget() {
+				fmt.Fprintln(Console, "******SIMULATION AND CUSTOMER BUCKETS ARE THE SAME*******")
+				logger.Event("******SIMULATION AND CUSTOMER BUCKETS ARE THE SAME*******")
+			} else {
+				fmt.Fprintln(Console, "******SIMULATION AND CUSTOMER BUCKETS ARE Not THE SAME*******")
+				logger.Fatal("******SIMULATION AND CUSTOMER BUCKETS DIFFER*******")
+			}
 		} else {
-			fmt.Println("******SIMULATION AND CUSTOMER BUCKETS ARE Not THE SAME*******")
-			logger.Fatal("******SIMULATION AND CUSTOMER BUCKETS DIFFER*******")
+			logger.Event("******CHECKING THE TARGET*******")
+			if dbManager.VerifyTarget() {
+				fmt.Fprintln(Console, "******TARGET MATCHES THE VERSIONS WRITTEN*******")
+				logger.Event("******TARGET MATCHES THE VERSIONS WRITTEN*******")
+			} else {
+				fmt.Fprintln(Console, "******TARGET DOES NOT MATCH THE VERSIONS WRITTEN*******")
+				logger.Fatal("******TARGET DIFFERS FROM THE VERSIONS WRITTEN*******")
+			}
+		}
+	}
+}
+
+// SIGINT and SIGTERM stop reading after the current TLV and unload the tapes, a second one
+// exits at once. SIGUSR1 pauses reading and SIGUSR2 resumes it. The signals are only
+// caught while tapes are read, the returned function restores their default action
+func handleSignals(control *RunControl, logger *Logger) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				fmt.Fprintln(Console, "Pausing, send SIGUSR2 to resume")
+				logger.Event("Paused by signal")
+				control.Pause()
+			case syscall.SIGUSR2:
+				fmt.Fprintln(Console, "Resuming")
+				logger.Event("Resumed by signal")
+				control.Resume()
+			default:
+				if control.Stopping() {
+					logger.Fatal("Stopped by second signal, tapes may still be loaded")
+				}
+				fmt.Fprintln(Console, "Stopping, finishing the current TLV and unloading the tapes, signal again to exit now")
+				logger.Event("Stopping by signal: ", sig)
+				control.Stop()
+			}
 		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
 	}
 }
 
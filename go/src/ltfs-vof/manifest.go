@@ -0,0 +1,132 @@
+// records where each restored version came from and what the target made of it
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	. "ltfs-vof/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MANIFEST_VERIFIED  = "verified"
+	MANIFEST_MISMATCH  = "mismatch"
+	MANIFEST_UNCHECKED = "unchecked"
+)
+
+// a block of a version on tape, a block stored in the version record has no pack
+type ManifestSource struct {
+	Tape   string `json:"tape,omitempty"`
+	Pack   string `json:"pack,omitempty"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// one line of the manifest for each version or delete marker sent to the target
+type ManifestRecord struct {
+	Bucket          string           `json:"bucket"`
+	Key             string           `json:"key"`
+	VersionID       string           `json:"versionId"`
+	DeleteMarker    bool             `json:"deleteMarker,omitempty"`
+	Size            int64            `json:"size"`
+	ETag            string           `json:"etag,omitempty"`
+	Sources         []ManifestSource `json:"sources,omitempty"`
+	TargetBucket    string           `json:"targetBucket,omitempty"`
+	TargetKey       string           `json:"targetKey,omitempty"`
+	TargetVersionID string           `json:"targetVersionId,omitempty"`
+	TargetETag      string           `json:"targetEtag,omitempty"`
+	Uploaded        time.Time        `json:"uploaded"`
+	Verification    string           `json:"verification"`
+}
+
+// the manifest is appended to so a run that continues a stopped restore adds to it
+type Manifest struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+	logger  *Logger
+}
+
+func NewManifest(path string, logger *Logger) *Manifest {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		logger.Fatal("Unable to open manifest: ", path, err)
+	}
+	logger.Event("Manifest: ", path)
+	return &Manifest{file: file, encoder: json.NewEncoder(file), logger: logger}
+}
+
+// write the record and sync it so the manifest holds every version the target has
+func (m *Manifest) Write(record *ManifestRecord) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.encoder.Encode(record); err != nil {
+		m.logger.Fatal("Unable to write manifest", err)
+	}
+	if err := m.file.Sync(); err != nil {
+		m.logger.Fatal("Unable to sync manifest", err)
+	}
+}
+
+func (m *Manifest) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.file.Close(); err != nil {
+		m.logger.Event("Unable to close manifest", err)
+	}
+}
+
+// compare the etag of the version record with the etag the target reports, etags
+// of uploads split into different parts can not be compared
+func etagVerification(expected, actual string) string {
+	expected = strings.ToLower(strings.Trim(expected, "\""))
+	actual = strings.ToLower(strings.Trim(actual, "\""))
+	if expected == "" || actual == "" {
+		return MANIFEST_UNCHECKED
+	}
+	if expected == actual {
+		return MANIFEST_VERIFIED
+	}
+	expectedParts, actualParts := "", ""
+	if dash := strings.LastIndex(expected, "-"); dash > 0 {
+		expectedParts = expected[dash+1:]
+	}
+	if dash := strings.LastIndex(actual, "-"); dash > 0 {
+		actualParts = actual[dash+1:]
+	}
+	if expectedParts != actualParts {
+		return MANIFEST_UNCHECKED
+	}
+	return MANIFEST_MISMATCH
+}
+
+// the tape, pack and offset of each block of a version in logical order
+func (dbm *DBManager) getVersionSources(blockids []string) []ManifestSource {
+	var sources []ManifestSource
+	for _, blockid := range blockids {
+		_, entry := dbm.getBlockRecord(blockid)
+		sources = append(sources, ManifestSource{
+			Tape:   dbm.getPackTape(entry.GetPackName()),
+			Pack:   entry.GetPackName(),
+			Offset: entry.GetPhysicalStart(),
+			Length: entry.GetPhysicalLength(),
+		})
+	}
+	return sources
+}
+
+// returns the tape holding the pack, empty if it is not known
+func (dbm *DBManager) getPackTape(packid string) string {
+	if packid == "" {
+		return ""
+	}
+	var tapeid sql.NullString
+	err := dbm.db.QueryRow("SELECT tapeid FROM packs WHERE packid = ?", packid).Scan(&tapeid)
+	if err != nil {
+		return ""
+	}
+	return tapeid.String
+}
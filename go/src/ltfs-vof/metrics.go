@@ -0,0 +1,74 @@
+// prometheus metrics for long running restores, served over HTTP when a listen address is given
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	. "ltfs-vof/utils"
+	"net/http"
+)
+
+var (
+	metricTLVsRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ltfsvof_tlvs_read_total",
+		Help: "TLVs read from pack files by tag",
+	}, []string{"tag"})
+	metricBytesRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ltfsvof_bytes_read_total",
+		Help: "Block bytes read from tape by drive",
+	}, []string{"drive"})
+	metricVersionsUploaded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ltfsvof_versions_uploaded_total",
+		Help: "Object versions written to the target",
+	})
+	metricDeleteMarkers = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ltfsvof_delete_markers_total",
+		Help: "Delete markers applied to the target",
+	})
+	metricOrphans = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ltfsvof_orphan_blocks_total",
+		Help: "Blocks read before the pack list that claims them",
+	})
+	metricRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ltfsvof_retries_total",
+		Help: "Failed attempts that were retried by operation",
+	}, []string{"operation"})
+	metricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ltfsvof_errors_total",
+		Help: "Errors the run carried on past by the kind of thing that failed, a failed attempt, a pack, a tape or a TLV",
+	}, []string{"kind"})
+	metricS3Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ltfsvof_s3_requests_total",
+		Help: "Requests sent to the S3 target by operation",
+	}, []string{"operation"})
+	metricCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ltfsvof_cache_bytes",
+		Help: "Bytes of blocks in the cache",
+	})
+	metricDrivesInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ltfsvof_drives_in_use",
+		Help: "Drives with a tape loaded",
+	})
+)
+
+var tagNames = map[TagType]string{
+	BLOCK:         "block",
+	PACKLIST:      "packlist",
+	VERSION:       "version",
+	DELETEVERSION: "deleteversion",
+	METAFILE:      "metafile",
+}
+
+// serve the metrics on /metrics at the address, e.g. :9100
+func StartMetrics(address string, logger *Logger) {
+	prometheus.MustRegister(metricTLVsRead, metricBytesRead, metricVersionsUploaded, metricDeleteMarkers,
+		metricOrphans, metricRetries, metricErrors, metricS3Requests, metricCacheBytes, metricDrivesInUse)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		logger.Event("Serving metrics on: ", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			logger.Event("Metrics listener stopped: ", err)
+		}
+	}()
+}
@@ -0,0 +1,173 @@
+// works out from the database which tapes need to be loaded for a restore, the bytes
+// to read from each and the order to load them
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	. "ltfs-vof/utils"
+	"sort"
+	"strconv"
+)
+
+// what is left to read from a pack
+type packNeed struct {
+	bytes   int64 // bytes of blocks that have not been read
+	unknown bool  // holds data whose size is not known until a pack list is read
+}
+
+type TapePlan struct {
+	Tapes   []string            // tapes in the order they should be loaded
+	Packs   map[string][]string // packs to read on each tape from oldest to newest
+	Bytes   map[string]int64    // bytes to read from each tape
+	Unknown map[string]int      // packs on each tape whose size is not yet known
+}
+
+// computes the minimal set of tapes holding data for the versions selected by the filter
+func (dbm *DBManager) PlanTapes() *TapePlan {
+	dbm.lock()
+	tapeids, packids := dbm.getTapesPacksTable()
+	needs := dbm.getNeededPacks()
+	dbm.unlock()
+
+	plan := &TapePlan{
+		Packs:   make(map[string][]string),
+		Bytes:   make(map[string]int64),
+		Unknown: make(map[string]int),
+	}
+	for i, tapeid := range tapeids {
+		need, ok := needs[packids[i]]
+		if !ok {
+			continue
+		}
+		plan.Packs[tapeid] = append(plan.Packs[tapeid], packids[i])
+		plan.Bytes[tapeid] += need.bytes
+		if need.unknown {
+			plan.Unknown[tapeid]++
+		}
+	}
+
+	// sort the packs on each tape from oldest to newest
+	for tape, packs := range plan.Packs {
+		sort.Slice(packs, func(i, j int) bool {
+			_, timei := GetTimeFromID(packs[i], dbm.logger)
+			_, timej := GetTimeFromID(packs[j], dbm.logger)
+			return timei < timej
+		})
+		plan.Tapes = append(plan.Tapes, tape)
+	}
+	// order the tapes by the time of their oldest pack
+	sort.Slice(plan.Tapes, func(i, j int) bool {
+		_, oldi := GetTimeFromID(plan.Packs[plan.Tapes[i]][0], dbm.logger)
+		_, oldj := GetTimeFromID(plan.Packs[plan.Tapes[j]][0], dbm.logger)
+		return oldi < oldj
+	})
+	return plan
+}
+
+// returns the packs that hold data for selected versions that has not been read,
+// packs whose contents are unknown are needed while a selected pack list is unread
+func (dbm *DBManager) getNeededPacks() map[string]*packNeed {
+	needs := make(map[string]*packNeed)
+	unresolved := dbm.hasUnresolvedPackLists()
+	selected := make(map[string]bool)
+	for pack, packMap := range dbm.getAllPackMaps() {
+		need := &packNeed{}
+		needed := false
+		// blocks of this pack are only known once a pack list is read
+		if len(packMap) == 0 && unresolved {
+			need.unknown = true
+			needed = true
+		}
+		for _, entry := range packMap {
+			// orphaned blocks are claimed by a pack list that has not been read
+			if entry.VersionID == "" {
+				if unresolved {
+					need.unknown = true
+					needed = true
+				}
+				continue
+			}
+			isSelected, ok := selected[entry.VersionID]
+			if !ok {
+				isSelected = dbm.IsVersionSelected(entry.VersionID)
+				selected[entry.VersionID] = isSelected
+			}
+			if !isSelected {
+				continue
+			}
+			// the pack list entry is needed until the pack list has been read
+			if entry.BlockID == "" {
+				_, _, _, _, blockids := dbm.getVersionInfo(entry.VersionID)
+				if len(blockids) == 0 {
+					need.unknown = true
+					needed = true
+				}
+				continue
+			}
+			if state, blockEntry := dbm.getBlockRecord(entry.BlockID); state == STATE_READY {
+				need.bytes += blockEntry.GetPhysicalLength()
+				needed = true
+			}
+		}
+		if needed {
+			needs[pack] = need
+		}
+	}
+	return needs
+}
+
+// true if a selected version is waiting on its pack list to be read
+func (dbm *DBManager) hasUnresolvedPackLists() bool {
+	v, err := dbm.db.Query("SELECT versionid, bucketkey, blocklist FROM versions WHERE ispacklist = 1 AND completed = 0")
+	if err != nil {
+		dbm.logger.Fatal("Could not read pack list versions", err)
+	}
+	defer v.Close()
+	for v.Next() {
+		var versionid string
+		var bucketkey string
+		var blockinfo []byte
+		err = v.Scan(&versionid, &bucketkey, &blockinfo)
+		if err != nil {
+			dbm.logger.Fatal("Could not read versionid", err)
+		}
+		var blocklist []string
+		json.Unmarshal(blockinfo, &blocklist)
+		if len(blocklist) == 0 && dbm.filter.MatchBucketKey(bucketkey, versionid) {
+			return true
+		}
+	}
+	return false
+}
+
+// print the tapes to pull for the restore in the order they will be loaded
+func (db *Database) PrintPlan() {
+	plan := db.dbManager.PlanTapes()
+	var drives map[string]int
+	plan.Tapes, _, drives = db.TapeSchedule(db.timing)
+	db.logger.Event("Tape Plan, #tapes: ", len(plan.Tapes), " order: ", plan.Tapes, " schedule: ", db.schedule, " drives: ", drives)
+
+	fmt.Fprintln(Console, "\nOrder\tTape\t\tDrive\t#Packs\tBytes")
+	var total int64
+	unknown := 0
+	for i, tape := range plan.Tapes {
+		note := ""
+		if plan.Unknown[tape] > 0 {
+			note = fmt.Sprintf("\t+%d packs of unknown size", plan.Unknown[tape])
+		}
+		// any free drive reads the tape unless the schedule gave it one
+		drive := "any"
+		if d, ok := drives[tape]; ok {
+			drive = strconv.Itoa(d)
+		}
+		fmt.Fprintf(Console, "%d\t%-16s%s\t%d\t%d%s\n", i+1, tape, drive, len(plan.Packs[tape]), plan.Bytes[tape], note)
+		db.logger.Event("Plan Tape: ", tape, " packs: ", plan.Packs[tape], " bytes: ", plan.Bytes[tape], " unknown packs: ", plan.Unknown[tape])
+		total += plan.Bytes[tape]
+		unknown += plan.Unknown[tape]
+	}
+	fmt.Fprintln(Console, "\nTapes: ", len(plan.Tapes), "  Bytes: ", total)
+	if unknown > 0 {
+		fmt.Fprintln(Console, "Packs of unknown size: ", unknown, " (their size is known once the pack lists are read)")
+	}
+}
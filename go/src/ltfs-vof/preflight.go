@@ -0,0 +1,106 @@
+// checks that every tape a restore needs is in the library before any tape is loaded
+package main
+
+import (
+	"fmt"
+	. "ltfs-vof/tapehardware"
+	. "ltfs-vof/utils"
+	"sort"
+)
+
+// returns the bucket/keys with data still to be read from each of the tapes given
+func (dbm *DBManager) GetObjectsOnTapes(tapes map[string]bool) map[string][]string {
+	dbm.lock()
+	defer dbm.unlock()
+
+	packTapes := dbm.getPackTapes()
+	objects := make(map[string]map[string]bool)
+	selected := make(map[string]bool)
+	for pack, packMap := range dbm.getAllPackMaps() {
+		tape := packTapes[pack]
+		if !tapes[tape] {
+			continue
+		}
+		for _, entry := range packMap {
+			if entry.VersionID == "" {
+				continue
+			}
+			isSelected, ok := selected[entry.VersionID]
+			if !ok {
+				isSelected = dbm.IsVersionSelected(entry.VersionID)
+				selected[entry.VersionID] = isSelected
+			}
+			if !isSelected {
+				continue
+			}
+			bucketkey, _, _, _, blockids := dbm.getVersionInfo(entry.VersionID)
+			// pack list entries only matter until the pack list has been read
+			if entry.BlockID == "" && len(blockids) > 0 {
+				continue
+			}
+			if entry.BlockID != "" {
+				if state, _ := dbm.getBlockRecord(entry.BlockID); state != STATE_READY {
+					continue
+				}
+			}
+			if objects[tape] == nil {
+				objects[tape] = make(map[string]bool)
+			}
+			objects[tape][bucketkey] = true
+		}
+	}
+	tapeObjects := make(map[string][]string)
+	for tape, keys := range objects {
+		for bucketkey := range keys {
+			tapeObjects[tape] = append(tapeObjects[tape], bucketkey)
+		}
+		sort.Strings(tapeObjects[tape])
+	}
+	return tapeObjects
+}
+
+// compare the tapes in the order with the cartridges in the library, the tapes that are
+// missing are listed with the objects they hold. Returns the order without the missing
+// tapes and false if tapes are missing and the restore should not continue
+func (db *Database) Preflight(order []string, cartridges []TapeCartridge, allowMissing bool) ([]string, bool) {
+	inLibrary := make(map[string]bool)
+	for _, cart := range cartridges {
+		inLibrary[cart.Name()] = true
+	}
+	var available []string
+	missing := make(map[string]bool)
+	for _, tape := range order {
+		if inLibrary[tape] {
+			available = append(available, tape)
+		} else {
+			missing[tape] = true
+		}
+	}
+	if len(missing) == 0 {
+		db.logger.Event("Preflight, all ", len(order), " tapes are in the library")
+		return available, true
+	}
+
+	// list the missing tapes and the objects that can not be restored without them
+	tapeObjects := db.dbManager.GetObjectsOnTapes(missing)
+	var missingTapes []string
+	for tape := range missing {
+		missingTapes = append(missingTapes, tape)
+	}
+	sort.Strings(missingTapes)
+	fmt.Fprintln(Console, "\nTAPES NOT IN LIBRARY: ", len(missingTapes))
+	for _, tape := range missingTapes {
+		fmt.Fprintf(Console, "%s\t#Objects: %d\n", tape, len(tapeObjects[tape]))
+		for _, bucketkey := range tapeObjects[tape] {
+			fmt.Fprintln(Console, "\t", bucketkey)
+		}
+		db.logger.Event("Preflight, tape not in library: ", tape, " objects: ", tapeObjects[tape])
+	}
+	if !allowMissing {
+		fmt.Fprintln(Console, "Restore not started, load the missing tapes or use -allow-missing to restore from the tapes available")
+		return available, false
+	}
+	fmt.Fprintln(Console, "Continuing with the ", len(available), " tapes available")
+	db.logger.Event("Preflight, continuing without tapes: ", missingTapes)
+	return available, true
+}
@@ -0,0 +1,152 @@
+// optional first pass that reads only the pack lists named in the catalog so the block map
+// of every version is known before any data is read
+package main
+
+import (
+	"fmt"
+	"io"
+	. "ltfs-vof/tapehardware"
+	. "ltfs-vof/utils"
+	"os"
+	"sort"
+)
+
+// returns the offsets of the unread pack lists of selected versions in each pack on each tape
+func (dbm *DBManager) GetPackListLocations() map[string]map[string][]int64 {
+	dbm.lock()
+	defer dbm.unlock()
+	packTapes := dbm.getPackTapes()
+	locations := make(map[string]map[string][]int64)
+	for pack, packMap := range dbm.getAllPackMaps() {
+		for offset, entry := range packMap {
+			if entry.BlockID != "" || entry.VersionID == "" || !dbm.IsVersionSelected(entry.VersionID) {
+				continue
+			}
+			// already read
+			if _, _, _, _, blockids := dbm.getVersionInfo(entry.VersionID); len(blockids) > 0 {
+				continue
+			}
+			tape := packTapes[pack]
+			if locations[tape] == nil {
+				locations[tape] = make(map[string][]int64)
+			}
+			locations[tape][pack] = append(locations[tape][pack], offset)
+		}
+	}
+	for _, packs := range locations {
+		for _, offsets := range packs {
+			sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		}
+	}
+	return locations
+}
+
+// load each tape holding unread pack lists and decode only the pack lists, tapes that are
+// not in the library or fail are left for the data read to find the pack lists
+func (db *Database) Prescan() {
+	locations := db.dbManager.GetPackListLocations()
+	if len(locations) == 0 {
+		fmt.Fprintln(Console, "Prescan, no pack lists to read")
+		db.logger.Event("Prescan, no pack lists to read")
+		return
+	}
+	drives, cartridges := db.library.Audit()
+	inLibrary := make(map[string]TapeCartridge)
+	for _, cart := range cartridges {
+		inLibrary[cart.Name()] = cart
+	}
+	var tapes []string
+	for tape := range locations {
+		tapes = append(tapes, tape)
+	}
+	sort.Strings(tapes)
+
+	// pack lists may complete versions whose blocks are already cached
+	db.dbManager.StartUploads()
+	driveReserve := NewResource(len(drives))
+	tapeCompleteChannel := make(chan bool, len(tapes))
+	tapeCount := 0
+	for _, name := range tapes {
+		if !db.control.Wait() {
+			break
+		}
+		tape, ok := inLibrary[name]
+		if !ok {
+			fmt.Fprintln(Console, "Prescan, tape not in library: ", name)
+			db.logger.Event("Prescan, tape not in library: ", name)
+			continue
+		}
+		driveNumber := driveReserve.Reserve()
+		fmt.Fprintln(Console, "Prescanning Tape: ", name, " on Drive#: ", driveNumber)
+		tapeCount++
+		go func(tape TapeCartridge, drive TapeDrive) {
+			err := db.withTape(tape, drive, func(sn string, packFilePaths map[string]string) error {
+				for pack, offsets := range locations[tape.Name()] {
+					err := db.retry.Do("prescan pack "+pack+" on tape "+tape.Name(), db.logger, func() error {
+						return db.readPackLists(pack, packFilePaths[pack], offsets)
+					})
+					if err != nil {
+						db.logger.Event("Prescan, pack failed: ", pack, " error: ", err)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				fmt.Fprintln(Console, "Prescan, tape failed: ", tape.Name(), " ", err)
+				db.logger.Event("Prescan, tape failed: ", tape.Name(), " error: ", err)
+			}
+			driveReserve.Release(driveNumber)
+			tapeCompleteChannel <- true
+		}(tape, drives[driveNumber])
+	}
+	for i := 0; i < tapeCount; i++ {
+		<-tapeCompleteChannel
+	}
+	close(tapeCompleteChannel)
+	driveReserve.Stop()
+	db.dbManager.FinishUploads()
+
+	remaining := 0
+	for _, packs := range db.dbManager.GetPackListLocations() {
+		for _, offsets := range packs {
+			remaining += len(offsets)
+		}
+	}
+	fmt.Fprintln(Console, "Prescan complete, tapes: ", tapeCount, " pack lists still unread: ", remaining)
+	db.logger.Event("Prescan complete, tapes: ", tapeCount, " pack lists still unread: ", remaining)
+}
+
+// seek to each pack list in the pack file and process it
+func (db *Database) readPackLists(pack, path string, offsets []int64) error {
+	if path == "" {
+		return fmt.Errorf("pack file not found on tape")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open pack file: %v", err)
+	}
+	defer file.Close()
+	for _, offset := range offsets {
+		if !db.control.Wait() {
+			return errStopped
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("unable to seek to pack list at offset %d: %v", offset, err)
+		}
+		tlv, err := ReadTLV(file, db.logger)
+		if err != nil {
+			return fmt.Errorf("unable to read pack list at offset %d: %v", offset, err)
+		}
+		if tlv.Tag() != PACKLIST {
+			return fmt.Errorf("no pack list at offset %d", offset)
+		}
+		metricTLVsRead.WithLabelValues(tagNames[tlv.Tag()]).Inc()
+		packs := ReadPackListRecord(file, tlv.DataLength(), db.logger)
+		if packs == nil {
+			return fmt.Errorf("unable to read pack list at offset %d", offset)
+		}
+		db.logger.Event("Prescan, processing pack list: ", pack, " offset: ", offset)
+		db.dbManager.ProcessPackList(pack, offset, packs)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// periodic progress of a restore for each drive and overall, printed to the terminal
+// and written to a JSON status file for other programs to read
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	. "ltfs-vof/utils"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type DriveStatus struct {
+	Drive         string  `json:"drive"`
+	Tape          string  `json:"tape"`
+	Pack          string  `json:"pack"`
+	BytesRead     int64   `json:"bytesRead"`
+	ThroughputMBs float64 `json:"throughputMBs"`
+	SecondsOnTape float64 `json:"secondsOnTape"`
+}
+
+type RestoreStatus struct {
+	Time             time.Time     `json:"time"`
+	ElapsedSeconds   float64       `json:"elapsedSeconds"`
+	Drives           []DriveStatus `json:"drives"`
+	TapesDone        int           `json:"tapesDone"`
+	TapesFailed      int           `json:"tapesFailed"`
+	TapesLeft        int           `json:"tapesLeft"`
+	BytesRead        int64         `json:"bytesRead"`
+	BytesPlanned     int64         `json:"bytesPlanned"`
+	VersionsUploaded int           `json:"versionsUploaded"`
+	VersionsPending  int           `json:"versionsPending"`
+	CacheBytes       int64         `json:"cacheBytes"`
+	ETASeconds       float64       `json:"etaSeconds"`
+}
+
+type driveProgress struct {
+	drive     string
+	pack      string
+	bytes     int64
+	tapeStart time.Time
+}
+
+type Progress struct {
+	mutex        sync.Mutex
+	drives       map[string]*driveProgress // keyed by tape
+	tapes        int
+	tapesDone    int
+	tapesFailed  int
+	versions     int // versions to upload when the restore started
+	bytesRead    int64
+	bytesPlanned int64
+	start        time.Time
+	statusFile   string
+	stop         chan bool
+	done         sync.WaitGroup
+	dbm          *DBManager
+}
+
+func NewProgress(statusFile string, dbm *DBManager) *Progress {
+	return &Progress{
+		drives:     make(map[string]*driveProgress),
+		statusFile: statusFile,
+		dbm:        dbm,
+	}
+}
+
+// start reporting every interval, no reports are made if the interval is zero
+func (p *Progress) Start(tapes int, bytesPlanned int64, versions int, interval time.Duration) {
+	p.mutex.Lock()
+	p.tapes = tapes
+	p.bytesPlanned = bytesPlanned
+	p.versions = versions
+	p.start = time.Now()
+	p.mutex.Unlock()
+	if interval <= 0 {
+		return
+	}
+	p.stop = make(chan bool)
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Report()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stop the periodic reports and make a final one
+func (p *Progress) Stop() {
+	if p.stop != nil {
+		close(p.stop)
+		p.done.Wait()
+		p.stop = nil
+	}
+	p.Report()
+}
+
+func (p *Progress) TapeStarted(tape, drive string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.drives[tape] = &driveProgress{drive: drive, tapeStart: time.Now()}
+}
+
+func (p *Progress) PackStarted(tape, pack string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if dp, ok := p.drives[tape]; ok {
+		dp.pack = pack
+	}
+}
+
+func (p *Progress) BytesRead(tape string, bytes int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.bytesRead += bytes
+	if dp, ok := p.drives[tape]; ok {
+		dp.bytes += bytes
+	}
+}
+
+func (p *Progress) TapeFinished(tape string, failed bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.drives, tape)
+	if failed {
+		p.tapesFailed++
+	} else {
+		p.tapesDone++
+	}
+}
+
+// take a snapshot of the restore
+func (p *Progress) Status() RestoreStatus {
+	uploaded, _ := p.dbm.UploadCounts()
+	cacheBytes, _, _, _, _ := p.dbm.cache.Usage()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	status := RestoreStatus{
+		Time:             now.UTC(),
+		ElapsedSeconds:   now.Sub(p.start).Seconds(),
+		TapesDone:        p.tapesDone,
+		TapesFailed:      p.tapesFailed,
+		TapesLeft:        p.tapes - p.tapesDone - p.tapesFailed,
+		BytesRead:        p.bytesRead,
+		BytesPlanned:     p.bytesPlanned,
+		VersionsUploaded: uploaded,
+		VersionsPending:  p.versions - uploaded,
+		CacheBytes:       cacheBytes,
+	}
+	if status.VersionsPending < 0 {
+		status.VersionsPending = 0
+	}
+	for tape, dp := range p.drives {
+		seconds := now.Sub(dp.tapeStart).Seconds()
+		ds := DriveStatus{Drive: dp.drive, Tape: tape, Pack: dp.pack, BytesRead: dp.bytes, SecondsOnTape: seconds}
+		if seconds > 0 {
+			ds.ThroughputMBs = float64(dp.bytes) / seconds / 1000 / 1000
+		}
+		status.Drives = append(status.Drives, ds)
+	}
+	sort.Slice(status.Drives, func(i, j int) bool {
+		return status.Drives[i].Drive < status.Drives[j].Drive
+	})
+	// estimate the time left from the rate the planned bytes have been read so far
+	if p.bytesRead > 0 && p.bytesPlanned > p.bytesRead {
+		rate := float64(p.bytesRead) / status.ElapsedSeconds
+		status.ETASeconds = float64(p.bytesPlanned-p.bytesRead) / rate
+	}
+	return status
+}
+
+// print the status and write it to the status file
+func (p *Progress) Report() {
+	status := p.Status()
+
+	fmt.Fprintf(Console, "\nPROGRESS %s  elapsed %s\n", status.Time.Format(time.RFC3339), formatSeconds(status.ElapsedSeconds))
+	for _, ds := range status.Drives {
+		fmt.Fprintf(Console, "Drive: %-16s Tape: %-12s Pack: %s  Bytes: %d  %.1f MB/s  On Tape: %s\n", ds.Drive, ds.Tape, ds.Pack, ds.BytesRead, ds.ThroughputMBs, formatSeconds(ds.SecondsOnTape))
+	}
+	fmt.Fprintf(Console, "Tapes done: %d failed: %d left: %d  Bytes: %d of %d  Versions uploaded: %d pending: %d  Cache: %d  ETA: %s\n",
+		status.TapesDone, status.TapesFailed, status.TapesLeft, status.BytesRead, status.BytesPlanned,
+		status.VersionsUploaded, status.VersionsPending, status.CacheBytes, formatSeconds(status.ETASeconds))
+
+	if p.statusFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		p.dbm.logger.Event("Unable to marshal status: ", err)
+		return
+	}
+	// write to a temporary file and rename so readers never see a partial file
+	tmp := p.statusFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		p.dbm.logger.Event("Unable to write status file: ", tmp, " ", err)
+		return
+	}
+	if err := os.Rename(tmp, p.statusFile); err != nil {
+		p.dbm.logger.Event("Unable to rename status file: ", p.statusFile, " ", err)
+	}
+}
@@ -0,0 +1,165 @@
+// rules that restore objects to buckets and keys other than the ones they came from
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	. "ltfs-vof/utils"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// a rule matches keys of the source bucket, any bucket if empty, that start with the
+// prefix and whose rest after the prefix matches the regex if one is given. The bucket
+// is replaced by the target bucket, the prefix by the target prefix and the regex by
+// the replacement in the same rest of the key it was matched against
+type RemapRule struct {
+	Bucket       string `json:"bucket"`
+	TargetBucket string `json:"targetBucket"`
+	Prefix       string `json:"prefix"`
+	TargetPrefix string `json:"targetPrefix"`
+	Regex        string `json:"regex"`
+	Replace      string `json:"replace"`
+	regex        *regexp.Regexp
+}
+
+// the rules are tried in the order of the file and the first that matches is used,
+// a key no rule matches is restored as it was
+type Remap struct {
+	rules []*RemapRule
+}
+
+// the rules file is a JSON list of rules
+func LoadRemap(rulesFile string, logger *Logger) *Remap {
+	data, err := ioutil.ReadFile(rulesFile)
+	if err != nil {
+		logger.Fatal("Unable to read remap rules: ", rulesFile, err)
+	}
+	var remap Remap
+	err = json.Unmarshal(data, &remap.rules)
+	if err != nil {
+		logger.Fatal("Unable to json unmarshal the remap rules: ", rulesFile, err)
+	}
+	for i, rule := range remap.rules {
+		if rule.Regex != "" {
+			rule.regex, err = regexp.Compile(rule.Regex)
+			if err != nil {
+				logger.Fatal("Remap rule ", i+1, " regex: ", rule.Regex, " ", err)
+			}
+		}
+		if rule.TargetBucket != "" && !validBucketName(rule.TargetBucket) {
+			logger.Fatal("Remap rule ", i+1, " target bucket is not a valid bucket name: ", rule.TargetBucket)
+		}
+		logger.Event("Remap rule ", i+1, ": ", *rule)
+	}
+	return &remap
+}
+
+// returns the target bucket and key of a source bucket and key
+func (r *Remap) Apply(bucket, key string) (string, string) {
+	if r == nil {
+		return bucket, key
+	}
+	for _, rule := range r.rules {
+		if rule.Bucket != "" && rule.Bucket != bucket {
+			continue
+		}
+		if !strings.HasPrefix(key, rule.Prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(key, rule.Prefix)
+		if rule.regex != nil {
+			if !rule.regex.MatchString(rest) {
+				continue
+			}
+			rest = rule.regex.ReplaceAllString(rest, rule.Replace)
+		}
+		if rule.TargetBucket != "" {
+			bucket = rule.TargetBucket
+		}
+		return bucket, rule.TargetPrefix + rest
+	}
+	return bucket, key
+}
+
+// bucket names are 3 to 63 lower case letters, digits, dots and hyphens that start
+// and end with a letter or digit
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+func validBucketName(name string) bool {
+	return bucketName.MatchString(name) && !strings.Contains(name, "..")
+}
+
+// returns every bucket/key in the catalog, those still to be restored and those restored
+func (dbm *DBManager) GetBucketKeys() []string {
+	dbm.lock()
+	defer dbm.unlock()
+	keys := make(map[string]bool)
+	rows, err := dbm.db.Query("SELECT DISTINCT bucketkey FROM versions")
+	if err != nil {
+		dbm.logger.Fatal("Could not read versions", err)
+	}
+	for rows.Next() {
+		var bucketkey string
+		if err := rows.Scan(&bucketkey); err != nil {
+			dbm.logger.Fatal("Could not read versions", err)
+		}
+		keys[bucketkey] = true
+	}
+	rows.Close()
+	rows, err = dbm.db.Query("SELECT DISTINCT bucket, objectkey FROM versionmap")
+	if err != nil {
+		dbm.logger.Fatal("Could not read version map", err)
+	}
+	for rows.Next() {
+		var bucket, key string
+		if err := rows.Scan(&bucket, &key); err != nil {
+			dbm.logger.Fatal("Could not read version map", err)
+		}
+		keys[dbm.createBucketKey(bucket, key)] = true
+	}
+	rows.Close()
+	var bucketkeys []string
+	for bucketkey := range keys {
+		bucketkeys = append(bucketkeys, bucketkey)
+	}
+	sort.Strings(bucketkeys)
+	return bucketkeys
+}
+
+// check no two source keys are restored to the same target key and that every target
+// is a valid bucket and key, returns false and prints the problems if not
+func (db *Database) CheckRemap(remap *Remap) bool {
+	targets := make(map[string][]string)
+	var problems []string
+	for _, bucketkey := range db.dbManager.GetBucketKeys() {
+		bucket, key := db.dbManager.getBucketKey(bucketkey)
+		targetBucket, targetKey := remap.Apply(bucket, key)
+		if !validBucketName(targetBucket) {
+			problems = append(problems, fmt.Sprintf("%s: target bucket %s is not a valid bucket name", bucketkey, targetBucket))
+		}
+		if targetKey == "" || len(targetKey) > 1024 {
+			problems = append(problems, fmt.Sprintf("%s: target key %q is not a valid key", bucketkey, targetKey))
+		}
+		target := targetBucket + "/" + targetKey
+		targets[target] = append(targets[target], bucketkey)
+	}
+	for target, sources := range targets {
+		if len(sources) > 1 {
+			problems = append(problems, fmt.Sprintf("%s: restored from %s", target, strings.Join(sources, ", ")))
+		}
+	}
+	if len(problems) == 0 {
+		db.logger.Event("Remap, no collisions in ", len(targets), " keys")
+		return true
+	}
+	sort.Strings(problems)
+	fmt.Fprintln(Console, "\nREMAP PROBLEMS: ", len(problems))
+	for _, problem := range problems {
+		fmt.Fprintln(Console, "\t", problem)
+		db.logger.Event("Remap problem: ", problem)
+	}
+	return false
+}
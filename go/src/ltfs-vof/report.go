@@ -0,0 +1,172 @@
+// reports the versions left in the database that were never uploaded along with
+// the packs and tapes that would be needed to complete them
+package main
+
+import (
+	"fmt"
+	. "ltfs-vof/utils"
+	"sort"
+	"strings"
+)
+
+// a block of a version that has not been read from tape
+type MissingBlock struct {
+	BlockID string
+	Pack    string
+	Offset  int64
+	Tape    string
+}
+
+// a version that is still in the versions table
+type IncompleteVersion struct {
+	VersionID     string
+	Bucket        string
+	Key           string
+	DeleteMarker  bool
+	Reason        string
+	MissingBlocks []MissingBlock
+	Packs         []string
+	Tapes         []string
+}
+
+// returns every version that has not been completed from oldest to newest
+func (dbm *DBManager) GetIncompleteVersions() []*IncompleteVersion {
+	dbm.lock()
+	defer dbm.unlock()
+
+	packTapes := dbm.getPackTapes()
+	packMaps := dbm.getAllPackMaps()
+
+	// find the packs that hold the pack list for each version
+	packListPacks := make(map[string][]string)
+	for pack, packMap := range packMaps {
+		for _, entry := range packMap {
+			if entry.BlockID == "" && entry.VersionID != "" {
+				packListPacks[entry.VersionID] = append(packListPacks[entry.VersionID], pack)
+			}
+		}
+	}
+
+	var incomplete []*IncompleteVersion
+	for _, versionID := range dbm.getAllVersionsNotCompleted() {
+		bucketkey, _, deleteMarker, ispacklist, blockids := dbm.getVersionInfo(versionID)
+		bucket, key := dbm.getBucketKey(bucketkey)
+		iv := &IncompleteVersion{
+			VersionID:    versionID,
+			Bucket:       bucket,
+			Key:          key,
+			DeleteMarker: deleteMarker,
+		}
+		packs := make(map[string]bool)
+		switch {
+		case deleteMarker:
+			iv.Reason = "delete marker waiting on an older version"
+		case len(blockids) == 0 && ispacklist:
+			iv.Reason = "pack list never read"
+			for _, pack := range packListPacks[versionID] {
+				packs[pack] = true
+			}
+		default:
+			for _, blockid := range blockids {
+				state, entry := dbm.getBlockRecord(blockid)
+				if state == STATE_CACHED {
+					continue
+				}
+				iv.MissingBlocks = append(iv.MissingBlocks, MissingBlock{
+					BlockID: blockid,
+					Pack:    entry.GetPackName(),
+					Offset:  entry.GetPhysicalStart(),
+					Tape:    packTapes[entry.GetPackName()],
+				})
+				packs[entry.GetPackName()] = true
+			}
+			if len(iv.MissingBlocks) == 0 {
+				iv.Reason = "all blocks cached, waiting on an older version"
+			} else {
+				iv.Reason = "blocks never read"
+			}
+		}
+		// tapes the missing data was expected on
+		tapes := make(map[string]bool)
+		for pack := range packs {
+			iv.Packs = append(iv.Packs, pack)
+			tape := packTapes[pack]
+			if tape == "" {
+				tape = "unknown"
+			}
+			tapes[tape] = true
+		}
+		for tape := range tapes {
+			iv.Tapes = append(iv.Tapes, tape)
+		}
+		sort.Strings(iv.Packs)
+		sort.Strings(iv.Tapes)
+		incomplete = append(incomplete, iv)
+	}
+	return incomplete
+}
+
+// print and log a report of every version that was never uploaded
+func (db *Database) ReportIncomplete() int {
+	incomplete := db.dbManager.GetIncompleteVersions()
+	if len(incomplete) == 0 {
+		fmt.Fprintln(Console, "All versions have been restored")
+		db.logger.Event("Incomplete Version Report: all versions have been restored")
+		return 0
+	}
+
+	// count the versions waiting on each tape so operators know which cartridges to find
+	tapeCounts := make(map[string]int)
+	for _, iv := range incomplete {
+		for _, tape := range iv.Tapes {
+			tapeCounts[tape]++
+		}
+	}
+
+	fmt.Fprintln(Console, "\nINCOMPLETE VERSIONS: ", len(incomplete))
+	db.logger.Event("Incomplete Version Report, #versions: ", len(incomplete))
+	for _, iv := range incomplete {
+		fmt.Fprintf(Console, "%s/%s\n\tVersion: %s\n\tReason: %s\n", iv.Bucket, iv.Key, iv.VersionID, iv.Reason)
+		for _, mb := range iv.MissingBlocks {
+			fmt.Fprintf(Console, "\tMissing Block: %s  Pack: %s  Offset: %d  Tape: %s\n", mb.BlockID, mb.Pack, mb.Offset, mb.Tape)
+		}
+		if len(iv.Packs) > 0 {
+			fmt.Fprintf(Console, "\tPacks: %s\n\tTapes: %s\n", strings.Join(iv.Packs, ","), strings.Join(iv.Tapes, ","))
+		}
+		db.logger.Event("Incomplete Version: ", iv.Bucket, "/", iv.Key, " version: ", iv.VersionID, " reason: ", iv.Reason, " missing blocks: ", len(iv.MissingBlocks), " packs: ", iv.Packs, " tapes: ", iv.Tapes)
+	}
+
+	// summary of tapes still needed
+	var tapes []string
+	for tape := range tapeCounts {
+		tapes = append(tapes, tape)
+	}
+	sort.Strings(tapes)
+	fmt.Fprintln(Console, "\nTape\t\t#Versions")
+	for _, tape := range tapes {
+		fmt.Fprintf(Console, "%-16s%d\n", tape, tapeCounts[tape])
+	}
+	return len(incomplete)
+}
+
+// prints the tapes that failed to be read and returns how many there are, after a read
+// only the tapes it read are reported
+func (db *Database) ReportFailedTapes() int {
+	failed := db.dbManager.GetFailedTapes()
+	var tapes []string
+	for tape := range failed {
+		if db.tapesRead == nil || db.tapesRead[tape] {
+			tapes = append(tapes, tape)
+		}
+	}
+	if len(tapes) == 0 {
+		return 0
+	}
+	sort.Strings(tapes)
+	fmt.Fprintln(Console, "\nFAILED TAPES: ", len(tapes))
+	for _, tape := range tapes {
+		fmt.Fprintf(Console, "%-16s%s\n", tape, failed[tape])
+		db.logger.Event("Failed Tape: ", tape, " error: ", failed[tape])
+	}
+	return len(tapes)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	. "ltfs-vof/tapehardware"
 	. "ltfs-vof/utils"
 	_ "modernc.org/sqlite"
 	"os"
+	"strings"
+	"time"
 )
 
 // THERE ARE THREE PLACES DATA CAN BE LOCATED
@@ -15,22 +19,51 @@ import (
 // 3. In one or more block files that are pointed to by a PACK RECORD, that exists in a block file, that is pointed to by the "Reference" field in the version record.
 
 // Restore all versions, deletemarkers, essentially make s3 repository look like
-// original
-func (db *Database) RestoreAll() {
-	// For version records that have the "DATA: stored as part of the version record they
-	// need to be scannned now so if they are the only version of an object they can be
-	// processed
-	versionRecordsWithData := db.dbManager.getVersionsInRecord()
-	db.logger.Event("Processing ", len(versionRecordsWithData), " version records that contain data")
-	for _, versionID := range versionRecordsWithData {
-		db.logger.Event("Writing in Record Data for VersionID: ", versionID)
-		db.dbManager.processVersion(versionID)
-	}
-
+// original. Returns false if the restore was not started because tapes are missing
+func (db *Database) RestoreAll(allowMissing bool) bool {
 	// audit the library
 	drives, tapes := db.library.Audit()
 	db.logger.Event("Audited Tape Library #cartridges: ", len(tapes), "  #drives: ", len(drives))
 
+	// get an ordered list of tapes from oldest to newest
+	// also get a list of the pack order on each tape from oldest to newest
+	timing := db.timing
+	timing.Drives = len(drives)
+	tapeCartridgeOrder, packsOrder, tapeDrives := db.TapeSchedule(timing)
+	db.logger.Event("Cartridge Order: ", tapeCartridgeOrder)
+	db.logger.Event("Pack Order: ", packsOrder)
+	if db.verifier != nil {
+		tapeCartridgeOrder, packsOrder = db.verifyOrder(tapeCartridgeOrder, packsOrder)
+		db.logger.Event("Verify Cartridge Order: ", tapeCartridgeOrder)
+	}
+
+	// check all the tapes are in the library before anything is loaded or written
+	tapeCartridgeOrder, ok := db.Preflight(tapeCartridgeOrder, tapes, allowMissing)
+	if !ok {
+		return false
+	}
+	// failures recorded by earlier runs are only reported for the tapes read again
+	db.tapesRead = make(map[string]bool)
+	for _, tape := range tapeCartridgeOrder {
+		db.tapesRead[tape] = true
+	}
+
+	// completed versions are uploaded by the workers while the tapes are read
+	db.dbManager.StartUploads()
+
+	// report progress against the bytes planned on the tapes being read
+	var bytesPlanned int64
+	plan := db.dbManager.PlanTapes()
+	for _, tape := range tapeCartridgeOrder {
+		bytesPlanned += plan.Bytes[tape]
+	}
+	db.progress.Start(len(tapeCartridgeOrder), bytesPlanned, db.dbManager.CountVersionsNotCompleted(), db.interval)
+
+	// versions with their data in the version record and versions made pending again
+	// with their blocks already cached are processed now, reading won't complete them
+	count := db.dbManager.ProcessCachedVersions()
+	db.logger.Event("Processed ", count, " versions that may have all their blocks cached")
+
 	// get resource allocation for tape drives
 	driveReserve := NewResource(len(drives))
 	db.logger.Event("Reserving drives")
@@ -38,13 +71,26 @@ func (db *Database) RestoreAll() {
 	// create a channel for goroutines to post to when completed
 	tapeCompleteChannel := make(chan bool, len(tapes))
 
-	// get an ordered list of tapes from oldest to newest
-	// also get a list of the pack order on each tape from oldest to newest
-	tapeCartridgeOrder, packsOrder := db.dbManager.GetTapePackOrder()
-	db.logger.Event("Cartridge Order: ", tapeCartridgeOrder)
-	db.logger.Event("Pack Order: ", packsOrder)
-	for _, nextTape := range tapeCartridgeOrder {
-		// get the tape from the list of tapes
+	// each drive reads the tapes the schedule gave it before any other
+	queue := newTapeQueue(tapeCartridgeOrder, tapeDrives)
+	tapeCount := 0
+	for {
+		// no new tapes are loaded while paused or once the run is stopping
+		if !db.control.Wait() {
+			break
+		}
+		// reserve a drive should hang until drive available
+		driveNumber := driveReserve.Reserve()
+		if db.control.Stopping() {
+			driveReserve.Release(driveNumber)
+			break
+		}
+		nextTape, ok := queue.next(driveNumber)
+		if !ok {
+			driveReserve.Release(driveNumber)
+			break
+		}
+		// get the tape from the list of tapes, preflight has checked it is there
 		var tape TapeCartridge
 		for _, c := range tapes {
 			if c.Name() == nextTape {
@@ -52,88 +98,46 @@ func (db *Database) RestoreAll() {
 				break
 			}
 		}
-		// if didn't find it then failed
-		if tape == nil {
-			db.logger.Fatal("Tape not found")
-		}
-		// reserve a drive should hang until drive available
-		driveNumber := driveReserve.Reserve()
-		fmt.Println("Processing Tape: ", tape.Name(), " on Drive#: ", driveNumber)
+		fmt.Fprintln(Console, "Processing Tape: ", tape.Name(), " on Drive#: ", driveNumber)
 		drive := drives[driveNumber]
+		tapeCount++
 		go func(tape TapeCartridge, drive TapeDrive) {
+			// a failed tape is recorded and unloaded so the other drives carry on
+			db.dbManager.SetTapeState(tape.Name(), TAPE_STATE_READING, "")
+			err := db.restoreTape(tape, drive, packsOrder[tape.Name()])
 
-			// load tape into drive
-			sn, exists := drive.SerialNumber()
-			if !exists {
-				db.logger.Fatal("Drive has not serial number:")
+			// if the drive could not load or mount the tape try it once in another drive,
+			// the new drive is reserved before the failed one is released so it differs
+			var de *driveError
+			if errors.As(err, &de) && db.retry.SwitchDrive && len(drives) > 1 {
+				if newDrive, ok := driveReserve.ReserveWithin(DRIVE_SWITCH_WAIT); ok {
+					driveReserve.Release(driveNumber)
+					driveNumber = newDrive
+					fmt.Fprintln(Console, "Moving Tape: ", tape.Name(), " to Drive#: ", driveNumber)
+					db.logger.Event("Moving tape: ", tape.Name(), " to drive: ", driveNumber, " after: ", err)
+					err = db.restoreTape(tape, drives[driveNumber], packsOrder[tape.Name()])
+				} else {
+					db.logger.Event("No other drive free to move tape: ", tape.Name())
+				}
 			}
-
-			db.logger.Event("Loading and Mounting tape: ", tape.Name(), " toDrive: ", sn)
-			status := db.library.Load(tape, drive)
-			// if unable to load tape
-			if !status {
-				db.logger.Fatal("Failed to load tape drive: ", sn)
+			// a stopped tape is left to be read again by the next run
+			if errors.Is(err, errStopped) {
+				db.progress.TapeFinished(tape.Name(), false)
+				db.logger.Event("Tape stopped: ", tape.Name())
+				db.dbManager.SetTapeState(tape.Name(), TAPE_STATE_READY, "stopped")
+				driveReserve.Release(driveNumber)
+				tapeCompleteChannel <- true
+				return
 			}
-
-			// mount the tape for LTFS get the pack files witht their full paths
-			_, packFilePaths, status := drive.MountLTFS()
-			if !status {
-				db.logger.Fatal("Failed to mount LTFS tape drive: ", sn)
+			db.progress.TapeFinished(tape.Name(), err != nil)
+			if err != nil {
+				metricErrors.WithLabelValues("tape").Inc()
+				fmt.Fprintln(Console, "Tape Failed: ", tape.Name(), " ", err)
+				db.logger.Event("Tape failed: ", tape.Name(), " error: ", err)
+				db.dbManager.SetTapeState(tape.Name(), TAPE_STATE_FAILED, err.Error())
+			} else {
+				db.dbManager.SetTapeState(tape.Name(), TAPE_STATE_COMPLETED, "")
 			}
-
-			// now read each pack from oldest to newest
-			for _, pack := range packsOrder[tape.Name()] {
-				fmt.Println("Tape Name: ", tape.Name(), "Pack: ", pack, " Processing Pack: ", packFilePaths[pack])
-				// open the pack file
-				db.logger.Event("Open Pack File: ", packFilePaths[pack])
-
-				file, err := os.Open(packFilePaths[pack])
-				if err != nil {
-					db.logger.Fatal("Unable to get open pack file: ", packFilePaths[pack])
-				}
-				db.logger.Event("Reading Pack, drive: ", sn, "  tape: ", tape.Name(), " pack: ", pack)
-				defer file.Close()
-				for {
-					// get current location in file
-					offset := db.currentFileLocation(file)
-
-					tlv := ReadTLV(file, db.logger)
-					if tlv == nil {
-						break
-					}
-					switch tlv.Tag() {
-					case BLOCK:
-						db.logger.Event("TLV is Block type datalength = ", tlv.DataLength())
-						block := ReadBlock(file, tlv.DataLength(), db.logger)
-
-						if block == nil {
-							db.logger.Fatal("unable to read block from pack file: ", packFilePaths[pack])
-						}
-						// see if there is a version record associated with this block
-						// if  there  is then cache the block and
-						if db.dbManager.doesVersionRecordExist(block.GetVersion()) {
-							// cache the block and send version to s3 if version is complete
-							db.dbManager.WriteBlock(pack, offset, db.currentFileLocation(file), block)
-							db.logger.Event("Read & Wrote Block Pack:", pack, " offset: ", offset)
-						} else {
-							db.logger.Event("Block not associated with a version record")
-						}
-					case PACKLIST:
-						db.logger.Event("TLV is packlist")
-						packs := ReadPackListRecord(file, tlv.DataLength(), db.logger)
-						if packs == nil {
-							db.logger.Fatal("unable to read packlist")
-						}
-						db.logger.Event("Processing Pack List", pack, " offset: ", offset)
-						db.dbManager.ProcessPackList(pack, offset, packs)
-					default:
-						db.logger.Fatal("TLV not of BLOCK or PACKLIST type")
-					}
-				}
-			}
-			db.logger.Event("Dismounting and Unloading tape: ", tape.Name(), " toDrive: ", sn)
-			drive.Unmount()
-			db.library.Unload(drive)
 			// release the drive and notify the channel
 			driveReserve.Release(driveNumber)
 			tapeCompleteChannel <- true
@@ -142,13 +146,215 @@ func (db *Database) RestoreAll() {
 
 	}
 	// wait for all tapes to complete and stop the resource manager
-	for i := 0; i < len(tapes); i++ {
+	for i := 0; i < tapeCount; i++ {
 		<-tapeCompleteChannel
 	}
 	close(tapeCompleteChannel)
 	driveReserve.Stop()
+	db.dbManager.FinishUploads()
+	db.progress.Stop()
+	db.PrintCacheStatus()
+	return true
+}
+
+// returned when a tape is not finished because the run is stopping
+var errStopped = errors.New("stopped")
 
+// load and mount the tape and read its packs from oldest to newest, the tape is
+// unloaded before returning. A pack that can not be read does not stop the packs
+// after it being read but the tape is reported as failed
+func (db *Database) restoreTape(tape TapeCartridge, drive TapeDrive, packs []string) error {
+	return db.withTape(tape, drive, func(sn string, packFilePaths map[string]string) error {
+		return db.readPacks(tape, sn, packFilePaths, packs)
+	})
 }
+
+// load the tape into the drive and mount LTFS, call fn with the pack files on the tape
+// and unload the tape when fn returns. Load and mount failures are returned as drive errors
+func (db *Database) withTape(tape TapeCartridge, drive TapeDrive, fn func(string, map[string]string) error) error {
+	sn, exists := drive.SerialNumber()
+	if !exists {
+		return fmt.Errorf("drive has no serial number")
+	}
+
+	// load tape into drive
+	db.logger.Event("Loading and Mounting tape: ", tape.Name(), " toDrive: ", sn)
+	err := db.retry.Do("load tape "+tape.Name()+" into drive "+sn, db.logger, func() error {
+		if !db.library.Load(tape, drive) {
+			return fmt.Errorf("failed to load tape into drive: %s", sn)
+		}
+		return nil
+	})
+	if err != nil {
+		return &driveError{err}
+	}
+	metricDrivesInUse.Inc()
+	defer func() {
+		metricDrivesInUse.Dec()
+		db.logger.Event("Dismounting and Unloading tape: ", tape.Name(), " toDrive: ", sn)
+		drive.Unmount()
+		err := db.retry.Do("unload tape "+tape.Name()+" from drive "+sn, db.logger, func() error {
+			if !db.library.Unload(drive) {
+				return fmt.Errorf("failed to unload tape from drive: %s", sn)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintln(Console, "Tape Not Unloaded: ", tape.Name(), " ", err)
+		}
+	}()
+
+	// mount the tape for LTFS get the pack files witht their full paths
+	var packFilePaths map[string]string
+	err = db.retry.Do("mount LTFS on drive "+sn, db.logger, func() error {
+		var status bool
+		_, packFilePaths, status = drive.MountLTFS()
+		if !status {
+			return fmt.Errorf("failed to mount LTFS on drive: %s", sn)
+		}
+		return nil
+	})
+	if err != nil {
+		return &driveError{err}
+	}
+	return fn(sn, packFilePaths)
+}
+
+// read the packs on a mounted tape
+func (db *Database) readPacks(tape TapeCartridge, sn string, packFilePaths map[string]string, packs []string) error {
+	db.progress.TapeStarted(tape.Name(), sn)
+	// now read each pack from oldest to newest
+	var failed []string
+	for _, pack := range packs {
+		if db.control.Stopping() {
+			return errStopped
+		}
+		fmt.Fprintln(Console, "Tape Name: ", tape.Name(), "Pack: ", pack, " Processing Pack: ", packFilePaths[pack])
+		// a pack read again from the start skips the blocks and pack lists already processed
+		err := db.retry.Do("read pack "+pack+" on tape "+tape.Name(), db.logger, func() error {
+			return db.readPack(pack, packFilePaths[pack], sn, tape.Name())
+		})
+		if errors.Is(err, errStopped) {
+			return err
+		}
+		if err != nil {
+			metricErrors.WithLabelValues("pack").Inc()
+			db.logger.Event("Pack failed, tape: ", tape.Name(), " pack: ", pack, " error: ", err)
+			failed = append(failed, pack+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d packs failed: %s", len(failed), len(packs), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// read the blocks and pack lists in a pack file
+func (db *Database) readPack(pack, path, sn, tapeName string) error {
+	if path == "" {
+		return fmt.Errorf("pack file not found on tape")
+	}
+	// open the pack file
+	db.logger.Event("Open Pack File: ", path)
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open pack file: %v", err)
+	}
+	defer file.Close()
+	db.logger.Event("Reading Pack, drive: ", sn, "  tape: ", tapeName, " pack: ", pack)
+	db.progress.PackStarted(tapeName, pack)
+
+	// blocks the catalog does not know about only need reading while a pack list is unread
+	unresolved := db.dbManager.HasUnresolvedPackLists()
+	var blocksRead, blocksSkipped int
+	var bytesSkipped int64
+	defer func() {
+		db.logger.Event("Pack read: ", pack, " blocks read: ", blocksRead, " blocks skipped: ", blocksSkipped, " bytes skipped: ", bytesSkipped)
+	}()
+	for {
+		// stop between TLVs so the catalog is never left mid update
+		if !db.control.Wait() {
+			return errStopped
+		}
+		// get current location in file
+		offset := db.currentFileLocation(file)
+
+		// only the end of the file ends the pack, any other error fails it
+		tlv, err := ReadTLV(file, db.logger)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read TLV at offset %d: %v", offset, err)
+		}
+		metricTLVsRead.WithLabelValues(tagNames[tlv.Tag()]).Inc()
+		// a TLV whose hash fails is skipped, the versions it holds are reported as failed.
+		// The payload is hashed as it is read and decoded from memory so it is read once
+		var payload io.Reader = file
+		if db.verifier != nil {
+			data, ok, err := VerifyTLV(file, tlv, db.logger)
+			if err != nil {
+				return fmt.Errorf("unable to verify TLV at offset %d: %v", offset, err)
+			}
+			db.verifier.TLVChecked(pack, offset, ok)
+			if !ok {
+				continue
+			}
+			payload = bytes.NewReader(data)
+		}
+		switch tlv.Tag() {
+		case BLOCK:
+			db.logger.Event("TLV is Block type datalength = ", tlv.DataLength())
+			// seek past the payload of blocks nobody needs
+			if db.verifier == nil && !db.dbManager.IsBlockNeeded(pack, offset, unresolved) {
+				if _, err := file.Seek(int64(tlv.DataLength()), io.SeekCurrent); err != nil {
+					return fmt.Errorf("unable to skip block at offset %d: %v", offset, err)
+				}
+				blocksSkipped++
+				bytesSkipped += int64(tlv.DataLength())
+				continue
+			}
+			blocksRead++
+			db.progress.BytesRead(tapeName, int64(tlv.DataLength()))
+			metricBytesRead.WithLabelValues(sn).Add(float64(tlv.DataLength()))
+			// pause reading while the cache is full
+			if waited := db.dbManager.WaitForCache(); waited > time.Second {
+				db.logger.Event("Cache quota reached, drive: ", sn, " waited: ", waited)
+			}
+			block := ReadBlock(payload, tlv.DataLength(), db.logger)
+			if block == nil {
+				return fmt.Errorf("unable to read block at offset %d", offset)
+			}
+			// the TLV length is the encoded block, simulated tapes made before that was so
+			// hold the length of the data and the next TLV would be read from the wrong place
+			if db.verifier == nil {
+				if end := db.currentFileLocation(file); end != offset+int64(len(tlv.header))+int64(tlv.DataLength()) {
+					return fmt.Errorf("block at offset %d is not the length its TLV gives, simulated tapes made by an older version must be made again with -simtapes", offset)
+				}
+			}
+			// see if there is a version record associated with this block that
+			// is selected by the filter, if there is then cache the block
+			if db.dbManager.IsVersionSelected(block.GetVersion()) {
+				// cache the block and send version to s3 if version is complete
+				db.dbManager.WriteBlock(pack, offset, db.currentFileLocation(file), block)
+				db.logger.Event("Read & Wrote Block Pack:", pack, " offset: ", offset)
+			} else {
+				db.logger.Event("Block not associated with a version record")
+			}
+		case PACKLIST:
+			db.logger.Event("TLV is packlist")
+			packs := ReadPackListRecord(payload, tlv.DataLength(), db.logger)
+			if packs == nil {
+				return fmt.Errorf("unable to read pack list at offset %d", offset)
+			}
+			db.logger.Event("Processing Pack List", pack, " offset: ", offset)
+			db.dbManager.ProcessPackList(pack, offset, packs)
+		default:
+			return fmt.Errorf("TLV at offset %d not of BLOCK or PACKLIST type", offset)
+		}
+	}
+}
+
 func (db *Database) currentFileLocation(file *os.File) int64 {
 	offset, err := file.Seek(0, io.SeekCurrent)
 	if err != nil {
@@ -0,0 +1,56 @@
+// retries the library moves, LTFS mounts and pack reads that fail for a while on real libraries
+package main
+
+import (
+	"errors"
+	"fmt"
+	. "ltfs-vof/utils"
+	"strings"
+	"time"
+)
+
+// how long a tape waits for another drive to be free before it is failed
+const DRIVE_SWITCH_WAIT = 10 * time.Minute
+
+type RetryPolicy struct {
+	Attempts    int           // attempts before giving up, at least one
+	Backoff     time.Duration // wait after the first failure, doubled after each failure
+	SwitchDrive bool          // move the tape to a different drive when load or mount keeps failing
+}
+
+// call fn until it succeeds or the attempts are used up, every attempt is logged
+func (p RetryPolicy) Do(operation string, logger *Logger, fn func() error) error {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	wait := p.Backoff
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		logger.Event("Attempt ", attempt, " of ", attempts, ": ", operation)
+		if err = fn(); err == nil {
+			return nil
+		}
+		// the run is stopping, there is no point trying again
+		if errors.Is(err, errStopped) {
+			return err
+		}
+		logger.Event("Attempt ", attempt, " of ", attempts, " failed: ", operation, " error: ", err)
+		metricErrors.WithLabelValues("attempt").Inc()
+		if attempt < attempts {
+			metricRetries.WithLabelValues(strings.Fields(operation)[0]).Inc()
+			time.Sleep(wait)
+			wait *= 2
+		}
+	}
+	return fmt.Errorf("%s failed after %d attempts: %v", operation, attempts, err)
+}
+
+// a load or mount failure that may succeed on a different drive
+type driveError struct {
+	err error
+}
+
+func (e *driveError) Error() string {
+	return e.err.Error()
+}
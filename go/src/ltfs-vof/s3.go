@@ -6,40 +6,40 @@ import (
 	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"io"
 	"io/ioutil"
 	. "ltfs-vof/utils"
 	"os"
+	"sync"
 	"time"
 )
 
 const SIMULATOR_SUFFIX string = "simul"
 
 type S3Simulator struct {
-	region string
-	bucket string
-	logger *Logger
+	endpoint S3Endpoint
+	bucket   string
+	logger   *Logger
 }
 
 // create a bucket for the simulator to write to as a source
-func NewS3Simulator(region, bucket string, versioning bool, logger *Logger) *S3Simulator {
+func NewS3Simulator(endpoint S3Endpoint, bucket string, versioning bool, logger *Logger) *S3Simulator {
 	// make the bucket with versioning or not
-	createBucket(region, bucket+SIMULATOR_SUFFIX, versioning, logger)
+	createBucket(endpoint, bucket+SIMULATOR_SUFFIX, versioning, logger)
 
 	return &S3Simulator{
-		region: region,
-		bucket: bucket + SIMULATOR_SUFFIX,
-		logger: logger,
+		endpoint: endpoint,
+		bucket:   bucket + SIMULATOR_SUFFIX,
+		logger:   logger,
 	}
 }
 
 // put a object to the s3 souce bucket
 func (s *S3Simulator) Put(objectName string, data []byte) {
 
-	client := getClient(s.region, s.logger)
+	client := getClient(s.endpoint, s.logger)
 	// create a reader
 	r := io.ReadSeeker(bytes.NewReader(data))
 
@@ -57,53 +57,92 @@ func (s *S3Simulator) Put(objectName string, data []byte) {
 	}
 }
 func (s *S3Simulator) Delete(objectName string) {
-	deleteObject(s.region, s.bucket, objectName, true, s.logger)
+	deleteObject(s.endpoint, s.bucket, objectName, true, s.logger)
 }
 
 // S3Customer is used to put data to the customer s3 target bucket
 type S3Customer struct {
-	region     string
-	directory  string
-	logger     *Logger
-	versioning bool
-	simulation bool
-	buckets    []string
+	endpoint S3Endpoint
+	// target buckets written to an endpoint other than the default
+	bucketEndpoints map[string]S3Endpoint
+	directory       string
+	logger          *Logger
+	versioning      bool
+	simulation      bool
+	buckets         []string
+	// the source buckets restored, each is compared with its simulator bucket
+	sourceBuckets map[string]bool
+	// upload workers check and create buckets at the same time
+	bucketLock sync.Mutex
+	// target bucket and key of each source bucket and key, nil restores them unchanged
+	remap *Remap
+	// a continued restore keeps what the earlier runs wrote to existing buckets
+	keepBuckets bool
 }
 
 // store parameters so that they don't need to be passed each time
-func NewS3Customer(region, directory string, versioning, simulation bool, logger *Logger) *S3Customer {
+func NewS3Customer(endpoint S3Endpoint, bucketEndpoints map[string]S3BucketEndpoint, directory string, versioning, simulation bool, logger *Logger) *S3Customer {
+	endpoint.check("default", logger)
+	logger.Event("S3 endpoint: ", endpoint)
+	merged := make(map[string]S3Endpoint)
+	for bucket, bucketEndpoint := range bucketEndpoints {
+		if !validBucketName(bucket) {
+			logger.Fatal("S3 endpoint bucket is not a valid bucket name: ", bucket)
+		}
+		merged[bucket] = endpoint.merge(bucketEndpoint)
+		merged[bucket].check(bucket, logger)
+		logger.Event("S3 endpoint for bucket ", bucket, ": ", merged[bucket])
+	}
 	return &S3Customer{
-		region:     region,
-		directory:  directory,
-		logger:     logger,
-		versioning: versioning,
-		simulation: simulation,
+		endpoint:        endpoint,
+		bucketEndpoints: merged,
+		directory:       directory,
+		logger:          logger,
+		versioning:      versioning,
+		simulation:      simulation,
+		sourceBuckets:   make(map[string]bool),
 	}
 }
 
-// for the S3 target the data is passed as a list of block files
-func (s *S3Customer) Put(bucketName, objectName string, blockFiles []string) {
+// the endpoint a target bucket is written to
+func (s *S3Customer) bucketEndpoint(bucket string) S3Endpoint {
+	if endpoint, ok := s.bucketEndpoints[bucket]; ok {
+		return endpoint
+	}
+	return s.endpoint
+}
+
+func (s *S3Customer) SetRemap(remap *Remap) {
+	s.remap = remap
+}
+
+// existing buckets are only checked, not cleaned out, used when continuing a restore
+func (s *S3Customer) KeepBuckets() {
+	s.keepBuckets = true
+}
+
+// for the S3 target the data is passed as a list of block files, the blocks are cached
+// under the source bucket and written to the remapped bucket and key
+func (s *S3Customer) PutVersion(sourceBucket, sourceKey, versionID string, blockFiles []string, meta *VersionMeta) *TargetResult {
 
 	// check for zero blocks
 	if len(blockFiles) == 0 {
 		s.logger.Fatal("Zero blocks files sent to Put")
 	}
-
-	// create bucket if doesn't exist
-	s.checkBucket(bucketName)
+	bucketName, objectName := s.remap.Apply(sourceBucket, sourceKey)
+	s.logger.Event("S3, Put Object, bucket: ", bucketName, "  key: ", objectName, "  Endpoint: ", s.bucketEndpoint(bucketName), " Block count: ", len(blockFiles))
 
 	// if not in simulation mode and has more then one block file
 	// then multipart upload
 	if !s.simulation && len(blockFiles) > 1 {
-		s.putMultipart(bucketName, objectName, blockFiles)
-		return
+		return s.putMultipart(sourceBucket, bucketName, objectName, blockFiles)
 	}
 	// sum data from blockfiles together
 	var fullData []byte
 	for _, blockFile := range blockFiles {
 
 		// open the block file
-		f, err := os.Open(s.directory + "/" + bucketName + "/" + blockFile)
+		f, err := os.Open(s.directory + "/" + sourceBucket + "/" + blockFile)
 		if err != nil {
 			s.logger.Fatal("Unable to open block for single block: ", blockFile, "  upload: ", err)
 		}
@@ -126,18 +165,35 @@ func (s *S3Customer) Put(bucketName, objectName string, blockFiles []string) {
 	}
 
 	// put the object
-	client := getClient(s.region, s.logger)
-	_, err := client.PutObject(context.TODO(), params)
+	client := getClient(s.bucketEndpoint(bucketName), s.logger)
+	metricS3Requests.WithLabelValues("put").Inc()
+	output, err := client.PutObject(context.TODO(), params)
 	if err != nil {
 		s.logger.Fatal("S3 PUT: ", err.Error())
 	}
+	return &TargetResult{VersionID: aws.ToString(output.VersionId), ETag: aws.ToString(output.ETag), Bucket: bucketName, Key: objectName}
 }
-func (s *S3Customer) Delete(bucketName, objectName string) {
-	deleteObject(s.region, bucketName, objectName, true, s.logger)
+func (s *S3Customer) DeleteMarker(sourceBucket, sourceKey, versionID string, meta *VersionMeta) *TargetResult {
+	bucketName, objectName := s.remap.Apply(sourceBucket, sourceKey)
+	s.logger.Event("S3, Delete Marker, bucket: ", bucketName, "  key: ", objectName, "  Endpoint: ", s.bucketEndpoint(bucketName))
+	metricS3Requests.WithLabelValues("delete").Inc()
+	return &TargetResult{VersionID: deleteObject(s.bucketEndpoint(bucketName), bucketName, objectName, true, s.logger), Bucket: bucketName, Key: objectName}
+}
+
+// create the bucket the remap rules write the key to, the source bucket is kept so the
+// compare can find its simulator bucket
+func (s *S3Customer) EnsureBucket(sourceBucket, sourceKey string) {
+	s.bucketLock.Lock()
+	s.sourceBuckets[sourceBucket] = true
+	s.bucketLock.Unlock()
+	bucketName, _ := s.remap.Apply(sourceBucket, sourceKey)
+	s.checkBucket(bucketName)
 }
 
 // checks to see if bucket has already been created and if not creates it
 func (s *S3Customer) checkBucket(bucketName string) {
+	s.bucketLock.Lock()
+	defer s.bucketLock.Unlock()
 	// if bucket is on list then return
 	for _, bucket := range s.buckets {
 		if bucket == bucketName {
@@ -148,14 +204,22 @@ func (s *S3Customer) checkBucket(bucketName string) {
 	// not on list put it there and create the bucket
 	s.buckets = append(s.buckets, bucketName)
 
+	// a continued restore must not remove the versions the earlier runs restored
+	endpoint := s.bucketEndpoint(bucketName)
+	if s.keepBuckets && doesExist(endpoint, bucketName, s.logger) {
+		s.logger.Event("Bucket ", bucketName, " exists, keeping the versions restored by earlier runs")
+		checkVersioning(endpoint, bucketName, s.versioning, s.logger)
+		return
+	}
+
 	// create the bucket
-	createBucket(s.region, bucketName, s.versioning, s.logger)
+	createBucket(endpoint, bucketName, s.versioning, s.logger)
 }
 
 // put using multipart where each block is a part
-func (s *S3Customer) putMultipart(bucket, key string, blockFiles []string) {
+func (s *S3Customer) putMultipart(sourceBucket, bucket, key string, blockFiles []string) *TargetResult {
 
-	client := getClient(s.region, s.logger)
+	client := getClient(s.bucketEndpoint(bucket), s.logger)
 
 	// input for starting a multipart upload
 	input := s3.CreateMultipartUploadInput{
@@ -164,6 +228,7 @@ func (s *S3Customer) putMultipart(bucket, key string, blockFiles []string) {
 	}
 
 	//send command to start copy and get the upload id as it is needed later
+	metricS3Requests.WithLabelValues("create_multipart").Inc()
 	createOutput, err := client.CreateMultipartUpload(context.TODO(), &input)
 
 	// see if command failed
@@ -180,7 +245,7 @@ func (s *S3Customer) putMultipart(bucket, key string, blockFiles []string) {
 	partsInfo := make([]types.CompletedPart, 0)
 	for partNum, block := range blockFiles {
 		// open file
-		f, err := os.Open(s.directory + "/" + bucket + "/" + block)
+		f, err := os.Open(s.directory + "/" + sourceBucket + "/" + block)
 		if err != nil {
 			s.logger.Fatal("Unable to open file for multipart upload: ", err)
 		}
@@ -193,12 +258,13 @@ func (s *S3Customer) putMultipart(bucket, key string, blockFiles []string) {
 		// create a reader
 		r := io.ReadSeeker(bytes.NewReader(data))
 		partInput := s3.UploadPartInput{
-			Bucket:     aws.String(bucket + "-test"),
+			Bucket:     aws.String(bucket),
 			Key:        aws.String(key),
 			PartNumber: aws.Int32(int32(partNum + 1)),
 			UploadId:   aws.String(uploadId),
 			Body:       r,
 		}
+		metricS3Requests.WithLabelValues("upload_part").Inc()
 		uploadResult, err := client.UploadPart(context.TODO(), &partInput)
 		if err != nil || uploadResult == nil {
 			s.logger.Fatal("Error uploading part: ", partNum, err)
@@ -217,36 +283,75 @@ func (s *S3Customer) putMultipart(bucket, key string, blockFiles []string) {
 	}
 
 	complete := s3.CompleteMultipartUploadInput{
-		Bucket:          aws.String(bucket + "-test"),
+		Bucket:          aws.String(bucket),
 		Key:             aws.String(key),
 		UploadId:        aws.String(uploadId),
 		MultipartUpload: &mpu,
 	}
+	metricS3Requests.WithLabelValues("complete_multipart").Inc()
 	compOutput, err := client.CompleteMultipartUpload(context.TODO(), &complete)
 	if err != nil || compOutput == nil {
 		s.logger.Fatal("Unable to complete multipart upload: ", err)
 	}
+	return &TargetResult{VersionID: aws.ToString(compOutput.VersionId), ETag: aws.ToString(compOutput.ETag), Bucket: bucket, Key: key}
 }
 
+// the customer buckets are compared with the simulator buckets they were restored from
+func (s *S3Customer) Verify() bool {
+	return s.Compare()
+}
+
+func (s *S3Customer) Close() {}
+
+// the versions in each simulator bucket are remapped to the bucket and key they were
+// restored to and compared with the versions listed in that bucket
 func (s *S3Customer) Compare() bool {
 
 	// if no buckets then throw error
-	if len(s.buckets) == 0 {
+	if len(s.sourceBuckets) == 0 {
 		s.logger.Fatal("No buckets to compare, -compare option must be ran with -read option")
 	}
-	// go through each bucket seen by S3 customer
-	for _, bucket := range s.buckets {
-		// get bucket objects
-		simulatorBucket := bucket + SIMULATOR_SUFFIX
-		s.logger.Event("Comparing versions between bucket: ", bucket, " and simulator bucket: ", simulatorBucket)
+	// the versions and delete markers expected in each target bucket
+	expectedVersions := make(map[string]map[string][]*types.ObjectVersion)
+	expectedDeleteMarkers := make(map[string]map[string][]*types.DeleteMarkerEntry)
+	// go through each source bucket seen by S3 customer
+	for sourceBucket := range s.sourceBuckets {
+		simulatorBucket := sourceBucket + SIMULATOR_SUFFIX
+		s.logger.Event("Comparing versions of simulator bucket: ", simulatorBucket)
 
 		// get a sorted map of versions and delete markers from the source bucket
 		sourceVersions, sourceDeleteMarkers := s.ListVersions(simulatorBucket)
+		for key, versions := range sourceVersions {
+			bucket, targetKey := s.remap.Apply(sourceBucket, key)
+			if expectedVersions[bucket] == nil {
+				expectedVersions[bucket] = make(map[string][]*types.ObjectVersion)
+			}
+			expectedVersions[bucket][targetKey] = versions
+		}
+		for key, markers := range sourceDeleteMarkers {
+			bucket, targetKey := s.remap.Apply(sourceBucket, key)
+			if expectedDeleteMarkers[bucket] == nil {
+				expectedDeleteMarkers[bucket] = make(map[string][]*types.DeleteMarkerEntry)
+			}
+			expectedDeleteMarkers[bucket][targetKey] = markers
+		}
+	}
+	buckets := make(map[string]bool)
+	for bucket := range expectedVersions {
+		buckets[bucket] = true
+	}
+	for bucket := range expectedDeleteMarkers {
+		buckets[bucket] = true
+	}
+	for bucket := range buckets {
+		s.logger.Event("Comparing versions restored to bucket: ", bucket)
+		sourceVersions, sourceDeleteMarkers := expectedVersions[bucket], expectedDeleteMarkers[bucket]
 
 		// get a sorted map of versions and delete markers from the results bucket
 		resultVersions, resultDeleteMarkers := s.ListVersions(bucket)
 
-		// check that the version maps are identical
+		// check that the version maps are identical, the keys match as the source
+		// keys were remapped
 
 		var keyFailure bool
 		if len(sourceVersions) != len(resultVersions) {
@@ -256,6 +361,7 @@ func (s *S3Customer) Compare() bool {
 		for key, sourceVersion := range sourceVersions {
 			if _, ok := resultVersions[key]; !ok {
 				keyFailure = true
+				s.logger.Event("Version missing for key:", key)
 				continue
 			}
 			// loop through the versions and compare the versionId and Etag
@@ -264,11 +370,6 @@ func (s *S3Customer) Compare() bool {
 				continue
 			}
 			for i, version := range sourceVersion {
-				// check key
-				if *version.Key != *resultVersions[key][i].Key {
-					keyFailure = true
-					s.logger.Event("Version key mismatch for key:", key)
-				}
 				// check etag (MD5)
 				if *version.ETag != *resultVersions[key][i].ETag {
 					keyFailure = true
@@ -291,13 +392,12 @@ func (s *S3Customer) Compare() bool {
 				deleteMarkerFailure = true
 				continue
 			}
-			// loop through the versions and compare the versionId and Etag
+			if len(sourceMarker) != len(resultDeleteMarkers[key]) {
+				deleteMarkerFailure = true
+				continue
+			}
+			// loop through the markers and compare which is latest
 			for i, source := range sourceMarker {
-				// check key
-				if *source.Key != *resultDeleteMarkers[key][i].Key {
-					deleteMarkerFailure = true
-				}
-				// check latest version
 				if *source.IsLatest != *resultDeleteMarkers[key][i].IsLatest {
 					deleteMarkerFailure = true
 				}
@@ -325,7 +425,7 @@ func (s *S3Customer) ListVersions(bucket string) (map[string][]*types.ObjectVers
 			KeyMarker: aws.String(keyMarker),
 			MaxKeys:   aws.Int32(1000),
 		}
-		client := getClient(s.region, s.logger)
+		client := getClient(s.bucketEndpoint(bucket), s.logger)
 		resp, err := client.ListObjectVersions(context.TODO(), params)
 		if err != nil {
 			s.logger.Fatal("Failed Listing Objects bucket: ", bucket, "  Error: ", err.Error())
@@ -355,12 +455,12 @@ func (s *S3Customer) ListVersions(bucket string) (map[string][]*types.ObjectVers
 }
 
 // these functions are used by both the S3 source simulator and the S3 customer target
-func createBucket(region, bucketName string, versioning bool, logger *Logger) {
+func createBucket(endpoint S3Endpoint, bucketName string, versioning bool, logger *Logger) {
 
 	// if bucket exist then clean it out and return
-	if doesExist(region, bucketName, logger) {
+	if doesExist(endpoint, bucketName, logger) {
 		logger.Event("Bucket ", bucketName, " already exists, cleaning out")
-		cleanout(region, bucketName, logger)
+		cleanout(endpoint, bucketName, logger)
 	} else {
 		// create bucket
 		logger.Event("Bucket ", bucketName, " doesn't exists creating it")
@@ -368,7 +468,7 @@ func createBucket(region, bucketName string, versioning bool, logger *Logger) {
 			Bucket: aws.String(bucketName),
 		}
 		// create bucket, print error
-		client := getClient(region, logger)
+		client := getClient(endpoint, logger)
 		_, err := client.CreateBucket(context.TODO(), bucketInput)
 		if err != nil {
 			logger.Fatal("S3Bucket.Create: ", err.Error())
@@ -383,22 +483,39 @@ func createBucket(region, bucketName string, versioning bool, logger *Logger) {
 				Status: types.BucketVersioningStatusEnabled,
 			},
 		}
-		client := getClient(region, logger)
+		client := getClient(endpoint, logger)
 		_, err := client.PutBucketVersioning(context.TODO(), versioningInput)
 		if err != nil {
 			logger.Fatal("S3Bucket.Versionsing: ", err.Error())
 		}
 	}
 }
-func deleteObject(region, bucket, key string, sleep bool, logger *Logger) {
+
+// the versioning of an existing bucket has to match the buckets the tapes were written from
+func checkVersioning(endpoint S3Endpoint, bucketName string, versioning bool, logger *Logger) {
+	client := getClient(endpoint, logger)
+	output, err := client.GetBucketVersioning(context.TODO(), &s3.GetBucketVersioningInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		logger.Fatal("S3Bucket.GetVersioning: ", bucketName, " ", err.Error())
+	}
+	enabled := output.Status == types.BucketVersioningStatusEnabled
+	if enabled != versioning {
+		logger.Fatal("Bucket ", bucketName, " versioning enabled: ", enabled, " the restore expects: ", versioning)
+	}
+}
+
+// returns the version ID of the delete marker created, empty if the bucket is not versioned
+func deleteObject(endpoint S3Endpoint, bucket, key string, sleep bool, logger *Logger) string {
 
 	logger.Event("Deleting object ", key, " from bucket ", bucket)
-	client := getClient(region, logger)
+	client := getClient(endpoint, logger)
 	params := &s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	}
-	_, err := client.DeleteObject(context.TODO(), params)
+	output, err := client.DeleteObject(context.TODO(), params)
 	if err != nil {
 		logger.Fatal("DeleteObject: ", err.Error())
 	}
@@ -406,10 +523,11 @@ func deleteObject(region, bucket, key string, sleep bool, logger *Logger) {
 	if sleep {
 		time.Sleep(1 * time.Second)
 	}
+	return aws.ToString(output.VersionId)
 }
 
 // List all versions and delete them including delete markers
-func cleanout(region, bucketName string, logger *Logger) {
+func cleanout(endpoint S3Endpoint, bucketName string, logger *Logger) {
 	// loop until no versions available in bucket
 	keyMarker := ""
 	for {
@@ -418,19 +536,19 @@ func cleanout(region, bucketName string, logger *Logger) {
 			KeyMarker: aws.String(keyMarker),
 			MaxKeys:   aws.Int32(1000),
 		}
-		fmt.Println("Cleaning out bucket ", bucketName, " Be patient this can take a while")
-		client := getClient(region, logger)
+		fmt.Fprintln(Console, "Cleaning out bucket ", bucketName, " Be patient this can take a while")
+		client := getClient(endpoint, logger)
 		resp, err := client.ListObjectVersions(context.TODO(), params)
 		if err != nil {
 			logger.Fatal("S3Bucket.Delete: ", err.Error())
 		}
 		// now delete each version
 		for _, version := range resp.Versions {
-			deleteVersion(region, bucketName, *version.Key, *version.VersionId, false, logger)
+			deleteVersion(endpoint, bucketName, *version.Key, *version.VersionId, false, logger)
 		}
 		// delete each delete marker
 		for _, deleteMarker := range resp.DeleteMarkers {
-			deleteVersion(region, bucketName, *deleteMarker.Key, *deleteMarker.VersionId, false, logger)
+			deleteVersion(endpoint, bucketName, *deleteMarker.Key, *deleteMarker.VersionId, false, logger)
 		}
 		keyMarker = *resp.KeyMarker
 		if keyMarker == "" {
@@ -440,8 +558,8 @@ func cleanout(region, bucketName string, logger *Logger) {
 }
 
 // returns false if bucket doesn't exist or don't have permissions
-func doesExist(region, bucketName string, logger *Logger) bool {
-	client := getClient(region, logger)
+func doesExist(endpoint S3Endpoint, bucketName string, logger *Logger) bool {
+	client := getClient(endpoint, logger)
 	// create the corresponding s3 bucket
 	params := &s3.HeadBucketInput{
 		Bucket: aws.String(bucketName),
@@ -454,18 +572,9 @@ func doesExist(region, bucketName string, logger *Logger) bool {
 	return true
 }
 
-func getClient(region string, logger *Logger) *s3.Client {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		logger.Fatal("unable to create s3 session")
-	}
-	return s3.NewFromConfig(cfg, func(options *s3.Options) {
-		options.Region = region
-	})
-}
-func deleteVersion(region, bucketName, objectName, versionID string, sleep bool, logger *Logger) {
+func deleteVersion(endpoint S3Endpoint, bucketName, objectName, versionID string, sleep bool, logger *Logger) {
 	logger.Event("Deleting version ", versionID, " of object ", objectName, " from bucket ", bucketName)
-	client := getClient(region, logger)
+	client := getClient(endpoint, logger)
 	params := &s3.DeleteObjectInput{
 		Bucket:    aws.String(bucketName),
 		Key:       aws.String(objectName),
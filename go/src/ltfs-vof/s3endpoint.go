@@ -0,0 +1,162 @@
+// the S3 services customer buckets are written to, AWS or any S3 compatible store
+// such as MinIO, Ceph or BlackPearl
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	. "ltfs-vof/utils"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// how to reach the service a bucket is written to, the zero value is AWS with the
+// default credentials
+type S3Endpoint struct {
+	// empty uses the region of the profile or us-east-1
+	Region string `json:"Region"`
+	// URL of an S3 compatible service, empty for AWS
+	URL string `json:"URL"`
+	// address buckets as URL/bucket instead of bucket.URL
+	PathStyle bool `json:"PathStyle"`
+	// PEM file of the certificate authorities that signed the service certificate
+	CABundle string `json:"CABundle"`
+	// do not check the service certificate
+	Insecure bool `json:"Insecure"`
+	// profile in the shared credentials and config files
+	Profile string `json:"Profile"`
+}
+
+// the settings of S3Endpoint for a bucket written to another service, a setting left
+// empty or unset is taken from the default so PathStyle and Insecure can turn it off
+type S3BucketEndpoint struct {
+	Region    string `json:"Region"`
+	URL       string `json:"URL"`
+	PathStyle *bool  `json:"PathStyle"`
+	CABundle  string `json:"CABundle"`
+	Insecure  *bool  `json:"Insecure"`
+	Profile   string `json:"Profile"`
+}
+
+// the default with the bucket settings given. A bucket CA bundle turns off an insecure
+// default and a bucket set insecure drops the default CA bundle
+func (e S3Endpoint) merge(bucket S3BucketEndpoint) S3Endpoint {
+	if bucket.Region != "" {
+		e.Region = bucket.Region
+	}
+	if bucket.URL != "" {
+		e.URL = bucket.URL
+	}
+	if bucket.CABundle != "" {
+		e.CABundle = bucket.CABundle
+		e.Insecure = false
+	}
+	if bucket.Profile != "" {
+		e.Profile = bucket.Profile
+	}
+	if bucket.PathStyle != nil {
+		e.PathStyle = *bucket.PathStyle
+	}
+	if bucket.Insecure != nil {
+		e.Insecure = *bucket.Insecure
+		if e.Insecure && bucket.CABundle == "" {
+			e.CABundle = ""
+		}
+	}
+	return e
+}
+
+func (e S3Endpoint) String() string {
+	s := "aws"
+	if e.URL != "" {
+		s = e.URL
+	}
+	if e.Region != "" {
+		s += " region: " + e.Region
+	}
+	if e.Profile != "" {
+		s += " profile: " + e.Profile
+	}
+	if e.PathStyle {
+		s += " path-style"
+	}
+	if e.Insecure {
+		s += " insecure"
+	}
+	return s
+}
+
+func (e S3Endpoint) check(name string, logger *Logger) {
+	if e.URL != "" {
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logger.Fatal("S3 endpoint ", name, " URL is not an http or https URL: ", e.URL)
+		}
+	}
+	if e.CABundle != "" && e.Insecure {
+		logger.Fatal("S3 endpoint ", name, " can not have both a CA bundle and insecure")
+	}
+	if e.CABundle != "" {
+		if _, err := os.Stat(e.CABundle); err != nil {
+			logger.Fatal("S3 endpoint ", name, " CA bundle: ", err)
+		}
+	}
+}
+
+// a client is made once for each endpoint and shared by the upload workers
+var s3Clients = struct {
+	sync.Mutex
+	clients map[S3Endpoint]*s3.Client
+}{clients: make(map[S3Endpoint]*s3.Client)}
+
+func getClient(endpoint S3Endpoint, logger *Logger) *s3.Client {
+	s3Clients.Lock()
+	defer s3Clients.Unlock()
+	if client, ok := s3Clients.clients[endpoint]; ok {
+		return client
+	}
+	var options []func(*config.LoadOptions) error
+	if endpoint.Profile != "" {
+		options = append(options, config.WithSharedConfigProfile(endpoint.Profile))
+	}
+	if endpoint.CABundle != "" {
+		f, err := os.Open(endpoint.CABundle)
+		if err != nil {
+			logger.Fatal("Unable to open CA bundle: ", endpoint.CABundle, err)
+		}
+		defer f.Close()
+		options = append(options, config.WithCustomCABundle(f))
+	}
+	if endpoint.Insecure {
+		options = append(options, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(transport *http.Transport) {
+			if transport.TLSClientConfig == nil {
+				transport.TLSClientConfig = &tls.Config{}
+			}
+			transport.TLSClientConfig.InsecureSkipVerify = true
+		})))
+	}
+	cfg, err := config.LoadDefaultConfig(context.TODO(), options...)
+	if err != nil {
+		logger.Fatal("unable to create s3 session for endpoint: ", endpoint, " ", err)
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if endpoint.Region != "" {
+			o.Region = endpoint.Region
+		} else if o.Region == "" {
+			o.Region = DEFAULT_REGION
+		}
+		if endpoint.URL != "" {
+			o.BaseEndpoint = aws.String(endpoint.URL)
+		}
+		o.UsePathStyle = endpoint.PathStyle
+	})
+	logger.Event("S3 client for endpoint: ", endpoint)
+	s3Clients.clients[endpoint] = client
+	return client
+}
@@ -0,0 +1,242 @@
+// chooses the order tapes are read in and the drive that reads each, either oldest pack
+// first or the order that keeps the least data staged in the cache
+package main
+
+const SCHEDULE_OLDEST string = "oldest"
+const SCHEDULE_CACHE string = "cache"
+
+// the cache aware schedule only considers this many of the oldest tapes not yet
+// scheduled at each step, so its work grows with the blocks and not the tapes squared
+const SCHEDULE_WINDOW int = 16
+
+// the cache as the tapes are added to the schedule one at a time, the blocks of each
+// tape are counted as read once the tapes before it on every drive have been. Versions
+// and keys are numbered and a tape that is only tried is undone, so trying a tape costs
+// the blocks on it and the versions they complete
+type scheduleState struct {
+	tapeBlocks  map[string][]scheduleBlock
+	tapeBytes   map[string]int64
+	pending     []int   // blocks of each version not yet read
+	bytes       []int64 // bytes of each version
+	waits       []bool  // false for delete markers, they are uploaded once the older versions are
+	unresolved  []bool  // pack list not read so the blocks are unknown
+	versionKey  []int
+	keyVersions [][]int // versions of each key oldest to newest
+	next        []int   // the next version of each key to upload
+	cache       int64
+	undoPending []scheduleUndo
+	undoNext    []scheduleUndo
+}
+
+type scheduleBlock struct {
+	version int
+	bytes   int64
+}
+
+// the value an index had before a tape was tried
+type scheduleUndo struct {
+	index int
+	value int
+}
+
+func newScheduleState(model *restoreModel) *scheduleState {
+	s := &scheduleState{
+		tapeBlocks: make(map[string][]scheduleBlock),
+		tapeBytes:  make(map[string]int64),
+		cache:      model.cached,
+	}
+	versionIndex := make(map[string]int)
+	for _, versions := range model.keys {
+		key := len(s.keyVersions)
+		var indexes []int
+		for _, versionID := range versions {
+			mv := model.versions[versionID]
+			versionIndex[versionID] = len(s.pending)
+			indexes = append(indexes, len(s.pending))
+			s.pending = append(s.pending, mv.pending)
+			s.bytes = append(s.bytes, mv.bytes)
+			s.waits = append(s.waits, !mv.deleteMarker)
+			s.unresolved = append(s.unresolved, mv.unresolved)
+			s.versionKey = append(s.versionKey, key)
+		}
+		s.keyVersions = append(s.keyVersions, indexes)
+		s.next = append(s.next, 0)
+	}
+	for tape, packs := range model.plan.Packs {
+		for _, pack := range packs {
+			for _, block := range model.packBlocks[pack] {
+				s.tapeBlocks[tape] = append(s.tapeBlocks[tape], scheduleBlock{version: versionIndex[block.version], bytes: block.bytes})
+				s.tapeBytes[tape] += block.bytes
+			}
+		}
+	}
+	// versions already complete, such as data stored in the version record
+	for key := range s.keyVersions {
+		s.upload(key)
+	}
+	s.undoNext = nil
+	return s
+}
+
+// upload the versions of the key that are complete oldest first, their blocks leave the cache
+func (s *scheduleState) upload(key int) {
+	versions := s.keyVersions[key]
+	i := s.next[key]
+	for ; i < len(versions); i++ {
+		v := versions[i]
+		if !s.waits[v] {
+			continue
+		}
+		if s.unresolved[v] || s.pending[v] > 0 {
+			break
+		}
+		s.cache -= s.bytes[v]
+	}
+	if i != s.next[key] {
+		s.undoNext = append(s.undoNext, scheduleUndo{key, s.next[key]})
+		s.next[key] = i
+	}
+}
+
+// read the tape after the tapes already scheduled, returns the peak cache while it is
+// read and the cache once it is read. The state is only changed when commit is set
+func (s *scheduleState) read(tape string, commit bool) (int64, int64) {
+	start := s.cache
+	peak := s.cache
+	for _, block := range s.tapeBlocks[tape] {
+		s.cache += block.bytes
+		if s.cache > peak {
+			peak = s.cache
+		}
+		s.undoPending = append(s.undoPending, scheduleUndo{block.version, s.pending[block.version]})
+		s.pending[block.version]--
+		s.upload(s.versionKey[block.version])
+	}
+	end := s.cache
+	if !commit {
+		for i := len(s.undoPending) - 1; i >= 0; i-- {
+			s.pending[s.undoPending[i].index] = s.undoPending[i].value
+		}
+		for i := len(s.undoNext) - 1; i >= 0; i-- {
+			s.next[s.undoNext[i].index] = s.undoNext[i].value
+		}
+		s.cache = start
+	}
+	s.undoPending, s.undoNext = s.undoPending[:0], s.undoNext[:0]
+	return peak, end
+}
+
+// seconds a drive spends on the tape
+func (s *scheduleState) tapeSeconds(tape string, timing DriveTiming) float64 {
+	return timing.LoadSeconds + timing.MountSeconds + float64(s.tapeBytes[tape])/(timing.Throughput*1000*1000)
+}
+
+// builds the tape order one tape at a time, each time giving the drive free first the
+// tape in the window that keeps the peak cache lowest, then leaves the least data staged,
+// then is the longest so the drives finish together. Returns the order and the drive of
+// each tape, or the oldest first order and no drives if that is simulated to be better
+func (model *restoreModel) scheduleCacheAware(timing DriveTiming) ([]string, map[string]int) {
+	drives := timing.Drives
+	if drives < 1 {
+		drives = 1
+	}
+	state := newScheduleState(model)
+	driveFree := make([]float64, drives)
+	remaining := append([]string{}, model.plan.Tapes...)
+	var order []string
+	assignment := make(map[string]int)
+	for len(remaining) > 0 {
+		drive := 0
+		for d := range driveFree {
+			if driveFree[d] < driveFree[drive] {
+				drive = d
+			}
+		}
+		window := len(remaining)
+		if window > SCHEDULE_WINDOW {
+			window = SCHEDULE_WINDOW
+		}
+		best := 0
+		var bestPeak, bestEnd int64
+		var bestSeconds float64
+		for i, tape := range remaining[:window] {
+			peak, end := state.read(tape, false)
+			seconds := state.tapeSeconds(tape, timing)
+			if i == 0 || peak < bestPeak || (peak == bestPeak && (end < bestEnd || (end == bestEnd && seconds > bestSeconds))) {
+				best, bestPeak, bestEnd, bestSeconds = i, peak, end, seconds
+			}
+		}
+		tape := remaining[best]
+		state.read(tape, true)
+		driveFree[drive] += bestSeconds
+		assignment[tape] = drive
+		order = append(order, tape)
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+
+	// the greedy choice is not always better, keep the oldest first order if it isn't
+	if model.simulate(model.plan.Tapes, timing).better(model.simulate(order, timing)) {
+		return model.plan.Tapes, nil
+	}
+	return order, assignment
+}
+
+// true if the estimate stages less data or finishes sooner than the other
+func (e *restoreEstimate) better(other *restoreEstimate) bool {
+	if e.PeakCache != other.PeakCache {
+		return e.PeakCache < other.PeakCache
+	}
+	if e.EndCache != other.EndCache {
+		return e.EndCache < other.EndCache
+	}
+	return e.Seconds < other.Seconds
+}
+
+// the tapes to read in the order given by the schedule, the packs to read on each and
+// the drive the cache aware schedule gives each tape, nil when any free drive reads the next
+func (db *Database) TapeSchedule(timing DriveTiming) ([]string, map[string][]string, map[string]int) {
+	if db.schedule != SCHEDULE_CACHE {
+		order, packs := db.dbManager.GetTapePackOrder()
+		return order, packs, nil
+	}
+	model := db.dbManager.buildRestoreModel()
+	order, drives := model.scheduleCacheAware(timing)
+	db.logger.Event("Cache aware schedule: ", order, " drives: ", drives, " oldest first: ", model.plan.Tapes)
+	return order, model.plan.Packs, drives
+}
+
+// the tapes to read in the order given by the schedule and the packs to read on each
+func (db *Database) TapeOrder(timing DriveTiming) ([]string, map[string][]string) {
+	order, packs, _ := db.TapeSchedule(timing)
+	return order, packs
+}
+
+// hands out the tapes in order, a tape the schedule gave a drive is kept for that drive.
+// A drive with none of its tapes left takes the next tape so no drive waits idle when
+// the tapes take longer or shorter than estimated
+type tapeQueue struct {
+	tapes  []string
+	drives map[string]int
+	taken  map[string]bool
+}
+
+func newTapeQueue(order []string, drives map[string]int) *tapeQueue {
+	return &tapeQueue{tapes: order, drives: drives, taken: make(map[string]bool)}
+}
+
+// the next tape for the drive, false once every tape has been taken
+func (q *tapeQueue) next(drive int) (string, bool) {
+	for _, tape := range q.tapes {
+		if d, ok := q.drives[tape]; ok && d == drive && !q.taken[tape] {
+			q.taken[tape] = true
+			return tape, true
+		}
+	}
+	for _, tape := range q.tapes {
+		if !q.taken[tape] {
+			q.taken[tape] = true
+			return tape, true
+		}
+	}
+	return "", false
+}
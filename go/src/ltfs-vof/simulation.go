@@ -34,8 +34,12 @@ func writeSimBlock(packFile *os.File, packName string, blockData []byte, bucket
 		logger.Fatal("Unable to get start range for packFile: ", packFile.Name())
 	}
 	currBlock := NewBlock("", bucket, objectName, versionName, blockData, int64(blockRange[0]), int64(blockRange[1]))
-	WriteTLV(packFile, BLOCK, blockData, logger)
-	WriteBlock(packFile, currBlock, logger)
+	// the TLV length is the encoded block so readers can seek past it
+	encoded := EncodeBlock(currBlock, logger)
+	WriteTLV(packFile, BLOCK, encoded, logger)
+	if _, err := packFile.Write(encoded); err != nil {
+		logger.Fatal("Unable to write block to packFile: ", packFile.Name(), err)
+	}
 	logger.Event("Wrote Block to Pack File: ", packFile.Name(), " Object: ", objectName, " Version: ", versionName, " Block Range: ", blockRange)
 	endRange, err := packFile.Seek(0, io.SeekCurrent)
 	if err != nil {
@@ -238,12 +242,12 @@ func createSimulatedTapes(numberOfTapes int, s3Enabled bool, buckets []string, b
 		for _, bucket := range buckets {
 			// create the s3 simulation buckets
 			logger.Event("Creating simulated S3 bucket: ", bucket)
-			s3Buckets[bucket] = NewS3Simulator(DEFAULT_REGION, bucket, versioning, logger)
+			s3Buckets[bucket] = NewS3Simulator(S3Endpoint{Region: DEFAULT_REGION}, bucket, versioning, logger)
 		}
 	}
 
 	for tape := 0; tape < numberOfTapes; tape++ {
-		fmt.Println("Creating simulated tape", tape)
+		fmt.Fprintln(Console, "Creating simulated tape", tape)
 		// make the tape directory
 		err := os.MkdirAll(fmt.Sprintf("%stape%02d", SIMULATION_FILES, tape), 0755)
 		if err != nil {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/kbj/mtx"
 	"log"
+	. "ltfs-vof/utils"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -70,14 +71,14 @@ func (rtl *RealTapeLibrary) Print() {
 		log.Fatal("Unable to get drive list")
 	}
 	for _, drive := range drives {
-		fmt.Println("Drive: ", drive)
+		fmt.Fprintln(Console, "Drive: ", drive)
 	}
 	slots, err := rtl.mtx.Slots()
 	if err != nil {
 		log.Fatal("Unable to get slot list")
 	}
 	for _, slot := range slots {
-		fmt.Println("Slot: ", slot)
+		fmt.Fprintln(Console, "Slot: ", slot)
 	}
 }
 func (rtl *RealTapeLibrary) Audit() ([]TapeDrive, []TapeCartridge) {
@@ -91,7 +92,10 @@ func (rtl *RealTapeLibrary) Load(cart1 TapeCartridge, drive1 TapeDrive) bool {
 	// get cart and drive slots and perform load
 	cartSlot := cart.GetSlot()
 	driveSlot := drive.GetSlot()
-	rtl.mtx.Load(cartSlot, driveSlot)
+	if err := rtl.mtx.Load(cartSlot, driveSlot); err != nil {
+		log.Println("Unable to load cartridge: ", cart.Name(), " ", err)
+		return false
+	}
 
 	// update drive cartridge held
 	drive.SetCart(cart)
@@ -112,7 +116,10 @@ func (rtl *RealTapeLibrary) Unload(drive1 TapeDrive) bool {
 	cartSlot := cart.GetSlot()
 	driveSlot := drive.GetSlot()
 
-	rtl.mtx.Unload(cartSlot, driveSlot)
+	if err := rtl.mtx.Unload(cartSlot, driveSlot); err != nil {
+		log.Println("Unable to unload cartridge: ", cart.Name(), " ", err)
+		return false
+	}
 
 	// set drive to no cartridge
 	drive.SetCart(nil)
@@ -158,7 +165,7 @@ func NewRealTapeDrive(id, slot int, cartridge *RealTapeCartridge, info *TapeDriv
 	return &rtd
 }
 func (rtd RealTapeDrive) Print() {
-	fmt.Println("id: ", rtd.id, "  slot: ", rtd.slot, "  device: ", rtd.driveInfo.Device, "  cart: ", rtd.cartridge)
+	fmt.Fprintln(Console, "id: ", rtd.id, "  slot: ", rtd.slot, "  device: ", rtd.driveInfo.Device, "  cart: ", rtd.cartridge)
 }
 func (rtd *RealTapeDrive) GetSlot() int {
 	return rtd.slot
@@ -228,7 +235,7 @@ func NewRealTapeCartridge(slot int, slotType mtx.SlotType, volser string) *RealT
 	}
 }
 func (rtc RealTapeCartridge) Print() {
-	fmt.Println("slot: ", rtc.currentSlot, " type: ", rtc.slotType, "  volser: ", rtc.volser)
+	fmt.Fprintln(Console, "slot: ", rtc.currentSlot, " type: ", rtc.slotType, "  volser: ", rtc.volser)
 }
 func (rtc RealTapeCartridge) Name() string {
 	return rtc.volser
@@ -312,7 +319,7 @@ func FindVersionAndBlockFiles(mountPoint string) (versionFiles, blockFiles map[s
 	})
 
 	if err != nil {
-		fmt.Println("Error:", err)
+		fmt.Fprintln(Console, "Error:", err)
 	}
 	return versionFiles, blockFiles
 }
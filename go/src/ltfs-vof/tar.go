@@ -0,0 +1,312 @@
+// streams restored objects into tar files for handing the data to another site
+package main
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	. "ltfs-vof/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the last member of each tar lists the members before it, bucket names can not
+// start with a dot so it never collides with an object
+const TAR_INDEX_NAME = ".ltfs-vof-index.jsonl"
+
+// pax records that start with SCHILY.xattr. are restored as extended attributes by tar
+const TAR_XATTR_PREFIX = "SCHILY.xattr."
+
+// one line of the index of a tar
+type TarIndexEntry struct {
+	Name         string `json:"name,omitempty"`
+	Offset       int64  `json:"offset"` // of the header, or where a delete marker falls
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+	VersionID    string `json:"versionId"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	Modified     int64  `json:"modified"` // unix seconds
+	DeleteMarker bool   `json:"deleteMarker,omitempty"`
+}
+
+// writes each version as a member named <bucket>/<key>, a later version of a key
+// replaces the earlier one when extracted. Delete markers are only in the index.
+// Files are started at a new part once the size limit is reached, a pipe is one stream
+type TarTarget struct {
+	mutex    sync.Mutex
+	path     string
+	cacheDir string
+	maxBytes int64 // zero is no limit
+	pipe     bool
+	stdout   *os.File
+	part     int
+	file     *os.File
+	counter  *countingWriter
+	writer   *tar.Writer
+	index    []TarIndexEntry
+	// the index of each finished part file, used to verify them
+	parts  map[string][]TarIndexEntry
+	logger *Logger
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// path - writes to stdout, a named pipe is written as one stream. Otherwise the parts
+// are numbered, <name>-0001.tar, continuing after the parts of an earlier run
+func NewTarTarget(path, cacheDir string, maxBytes int64, logger *Logger) *TarTarget {
+	t := &TarTarget{path: path, cacheDir: cacheDir, maxBytes: maxBytes, parts: make(map[string][]TarIndexEntry), logger: logger}
+	if path == "-" {
+		// main prints messages to stderr so the tar is the only thing on stdout
+		t.pipe = true
+		t.stdout = os.Stdout
+	} else if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		t.pipe = true
+	}
+	if t.pipe && maxBytes > 0 {
+		logger.Event("Tar target is a pipe, the size limit is not used")
+		t.maxBytes = 0
+	}
+	logger.Event("Tar target: ", path, " pipe: ", t.pipe, " part size: ", t.maxBytes)
+	return t
+}
+
+// write the version as the next member, starting a new part first if it would not fit
+func (t *TarTarget) PutVersion(bucket, key, versionID string, blockFiles []string, meta *VersionMeta) *TargetResult {
+	var size int64
+	for _, blockFile := range blockFiles {
+		info, err := os.Stat(t.cacheDir + "/" + bucket + "/" + blockFile)
+		if err != nil {
+			t.logger.Fatal("Unable to stat block: ", blockFile, " for object: ", bucket, "/", key, err)
+		}
+		size += info.Size()
+	}
+	record := &fsMetadata{Bucket: bucket, Key: key, VersionID: versionID, VersionMeta: meta}
+	pax := make(map[string]string)
+	for name, value := range record.attributes() {
+		pax[TAR_XATTR_PREFIX+name] = value
+	}
+	modTime := meta.ModTime(versionID, t.logger)
+	header := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       bucket + "/" + key,
+		Size:       size,
+		Mode:       0644,
+		ModTime:    modTime,
+		PAXRecords: pax,
+		Format:     tar.FormatPAX,
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writer != nil && t.maxBytes > 0 && t.counter.count+size > t.maxBytes {
+		t.closePart()
+	}
+	if t.writer == nil {
+		t.openPart()
+	}
+	entry := TarIndexEntry{
+		Name:      header.Name,
+		Offset:    t.counter.count,
+		Bucket:    bucket,
+		Key:       key,
+		VersionID: versionID,
+		Size:      size,
+		ETag:      meta.ETag,
+		Modified:  modTime.Unix(),
+	}
+	err := t.writer.WriteHeader(header)
+	if err != nil {
+		t.logger.Fatal("Unable to write tar header for: ", bucket, "/", key, err)
+	}
+	hash := md5.New()
+	for _, blockFile := range blockFiles {
+		f, err := os.Open(t.cacheDir + "/" + bucket + "/" + blockFile)
+		if err != nil {
+			t.logger.Fatal("Unable to open block: ", blockFile, " for object: ", bucket, "/", key, err)
+		}
+		_, err = io.Copy(io.MultiWriter(t.writer, hash), f)
+		f.Close()
+		if err != nil {
+			t.logger.Fatal("Unable to write block: ", blockFile, " to tar for object: ", bucket, "/", key, err)
+		}
+	}
+	err = t.writer.Flush()
+	if err != nil {
+		t.logger.Fatal("Unable to write tar member: ", bucket, "/", key, err)
+	}
+	t.index = append(t.index, entry)
+	t.logger.Event("Tar, wrote bucket: ", bucket, " key: ", key, " version: ", versionID, " part: ", t.part)
+	return &TargetResult{ETag: hex.EncodeToString(hash.Sum(nil))}
+}
+
+// a delete marker has no data so it is only recorded in the index
+func (t *TarTarget) DeleteMarker(bucket, key, versionID string, meta *VersionMeta) *TargetResult {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writer == nil {
+		t.openPart()
+	}
+	t.index = append(t.index, TarIndexEntry{
+		Offset:       t.counter.count,
+		Bucket:       bucket,
+		Key:          key,
+		VersionID:    versionID,
+		ETag:         meta.ETag,
+		Modified:     meta.ModTime(versionID, t.logger).Unix(),
+		DeleteMarker: true,
+	})
+	t.logger.Event("Tar, delete marker bucket: ", bucket, " key: ", key, " version: ", versionID, " part: ", t.part)
+	return &TargetResult{}
+}
+
+// the tar members are named by bucket so there is nothing to create
+func (t *TarTarget) EnsureBucket(bucket, key string) {}
+
+// read back each part file and check its members match its index
+func (t *TarTarget) Verify() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pipe {
+		t.logger.Event("Tar verify, a pipe can not be read back")
+		return true
+	}
+	ok := true
+	for name, index := range t.parts {
+		f, err := os.Open(name)
+		if err != nil {
+			t.logger.Event("Tar verify, unable to open: ", name, err)
+			ok = false
+			continue
+		}
+		reader := tar.NewReader(f)
+		for _, entry := range index {
+			if entry.DeleteMarker {
+				continue
+			}
+			header, err := reader.Next()
+			if err != nil || header.Name != entry.Name || header.Size != entry.Size {
+				t.logger.Event("Tar verify, member mismatch in: ", name, " expected: ", entry.Name, " size: ", entry.Size, err)
+				ok = false
+				break
+			}
+			if n, err := io.Copy(io.Discard, reader); err != nil || n != entry.Size {
+				t.logger.Event("Tar verify, short member in: ", name, " member: ", entry.Name, err)
+				ok = false
+				break
+			}
+		}
+		f.Close()
+	}
+	t.logger.Event("Tar verify, parts: ", len(t.parts), " ok: ", ok)
+	return ok
+}
+
+// write the index and end the last part
+func (t *TarTarget) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.writer != nil {
+		t.closePart()
+	}
+}
+
+func (t *TarTarget) openPart() {
+	t.part++
+	var out *os.File
+	if t.stdout != nil {
+		out = t.stdout
+	} else if t.pipe {
+		var err error
+		out, err = os.OpenFile(t.path, os.O_WRONLY, 0)
+		if err != nil {
+			t.logger.Fatal("Unable to open tar pipe: ", t.path, err)
+		}
+	} else {
+		for {
+			name := t.partName(t.part)
+			var err error
+			out, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+			if err == nil {
+				break
+			}
+			if !os.IsExist(err) {
+				t.logger.Fatal("Unable to create tar: ", name, err)
+			}
+			t.part++
+		}
+	}
+	t.file = out
+	t.counter = &countingWriter{w: out}
+	t.writer = tar.NewWriter(t.counter)
+	t.index = nil
+	t.logger.Event("Tar, started part: ", t.part, " ", out.Name())
+}
+
+func (t *TarTarget) closePart() {
+	var lines strings.Builder
+	encoder := json.NewEncoder(&lines)
+	for _, entry := range t.index {
+		if err := encoder.Encode(entry); err != nil {
+			t.logger.Fatal("Unable to marshal tar index", err)
+		}
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     TAR_INDEX_NAME,
+		Size:     int64(lines.Len()),
+		Mode:     0644,
+		ModTime:  time.Now(),
+		Format:   tar.FormatPAX,
+	}
+	err := t.writer.WriteHeader(header)
+	if err == nil {
+		_, err = io.WriteString(t.writer, lines.String())
+	}
+	if err == nil {
+		err = t.writer.Close()
+	}
+	if err != nil {
+		t.logger.Fatal("Unable to finish tar part: ", t.part, err)
+	}
+	// a copy of the index next to each file so the parts can be searched without reading them
+	if !t.pipe {
+		t.parts[t.file.Name()] = t.index
+		indexName := t.file.Name() + ".index.jsonl"
+		err = os.WriteFile(indexName, []byte(lines.String()), 0666)
+		if err != nil {
+			t.logger.Fatal("Unable to write tar index: ", indexName, err)
+		}
+	}
+	if t.path != "-" {
+		err = t.file.Close()
+		if err != nil {
+			t.logger.Fatal("Unable to close tar part: ", t.part, err)
+		}
+	}
+	t.logger.Event("Tar, finished part: ", t.part, " members: ", len(t.index), " bytes: ", t.counter.count)
+	t.writer = nil
+}
+
+func (t *TarTarget) partName(part int) string {
+	ext := filepath.Ext(t.path)
+	if ext == "" {
+		ext = ".tar"
+	}
+	return fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(t.path, filepath.Ext(t.path)), part, ext)
+}
@@ -0,0 +1,142 @@
+// the systems restored versions are written to
+package main
+
+import (
+	. "ltfs-vof/utils"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a target receives the versions of each key oldest first from the upload workers,
+// every method may be called by several workers at once for different keys
+type Target interface {
+	// create the bucket the key is written to if it does not exist, called before each
+	// version is written
+	EnsureBucket(bucket, key string)
+	// write a version from its cached blocks in logical order
+	PutVersion(bucket, key, versionID string, blockFiles []string, meta *VersionMeta) *TargetResult
+	// apply a delete marker to the key
+	DeleteMarker(bucket, key, versionID string, meta *VersionMeta) *TargetResult
+	// check what was written during the run, true if it is correct
+	Verify() bool
+	// called once no more versions will be written
+	Close()
+}
+
+// what the target reports for a version written, empty when the target has no
+// version IDs or does not hash what it writes
+type TargetResult struct {
+	VersionID string
+	ETag      string
+	// the bucket and key written when the target reports them
+	Bucket string
+	Key    string
+}
+
+const (
+	TARGET_S3   = "s3"
+	TARGET_FS   = "filesystem"
+	TARGET_TAR  = "tar"
+	TARGET_NULL = "null"
+)
+
+// the target settings from the config file and command line
+type TargetConfig struct {
+	Type string `json:"Type"`
+	// root directory of a filesystem target or the tar file name
+	Path string `json:"Path"`
+	// filesystem target only
+	KeepVersions bool   `json:"KeepVersions"`
+	Metadata     string `json:"Metadata"`
+	// tar target only, zero is one file
+	TarSizeGB float64 `json:"TarSizeGB"`
+	// s3 target only, rules file that restores to other buckets and keys
+	RemapFile string `json:"RemapFile"`
+	// s3 target only, the service buckets are written to and the buckets written
+	// elsewhere by name
+	S3        S3Endpoint                  `json:"S3"`
+	S3Buckets map[string]S3BucketEndpoint `json:"S3Buckets"`
+	// s3 target only, set from the command line
+	Versioning bool `json:"-"`
+	Simulation bool `json:"-"`
+}
+
+// adding a target only needs an entry here
+var targets = map[string]func(config TargetConfig, cacheDir string, logger *Logger) Target{
+	TARGET_S3: func(config TargetConfig, cacheDir string, logger *Logger) Target {
+		customer := NewS3Customer(config.S3, config.S3Buckets, cacheDir, config.Versioning, config.Simulation, logger)
+		if config.RemapFile != "" {
+			customer.SetRemap(LoadRemap(config.RemapFile, logger))
+		}
+		return customer
+	},
+	TARGET_FS: func(config TargetConfig, cacheDir string, logger *Logger) Target {
+		if config.Path == "" {
+			logger.Fatal("The filesystem target needs a root directory")
+		}
+		if config.Metadata == "" {
+			config.Metadata = FS_METADATA_JSON
+		}
+		return NewFSTarget(config.Path, cacheDir, config.KeepVersions, config.Metadata, logger)
+	},
+	TARGET_TAR: func(config TargetConfig, cacheDir string, logger *Logger) Target {
+		if config.Path == "" {
+			logger.Fatal("The tar target needs a file name")
+		}
+		return NewTarTarget(config.Path, cacheDir, int64(config.TarSizeGB*1000*1000*1000), logger)
+	},
+	TARGET_NULL: func(config TargetConfig, cacheDir string, logger *Logger) Target {
+		return NewNullTarget(logger)
+	},
+}
+
+func NewTarget(config TargetConfig, cacheDir string, logger *Logger) Target {
+	newTarget, ok := targets[config.Type]
+	if !ok {
+		var names []string
+		for name := range targets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		logger.Fatal("Unknown target: ", config.Type, " use one of ", strings.Join(names, ", "))
+	}
+	logger.Event("Target: ", config.Type)
+	return newTarget(config, cacheDir, logger)
+}
+
+// discards every version, used to read the tapes without writing anywhere
+type NullTarget struct {
+	mutex         sync.Mutex
+	versions      int
+	deleteMarkers int
+	logger        *Logger
+}
+
+func NewNullTarget(logger *Logger) *NullTarget {
+	return &NullTarget{logger: logger}
+}
+
+func (t *NullTarget) EnsureBucket(bucket, key string) {}
+
+func (t *NullTarget) PutVersion(bucket, key, versionID string, blockFiles []string, meta *VersionMeta) *TargetResult {
+	t.mutex.Lock()
+	t.versions++
+	t.mutex.Unlock()
+	return &TargetResult{}
+}
+
+func (t *NullTarget) DeleteMarker(bucket, key, versionID string, meta *VersionMeta) *TargetResult {
+	t.mutex.Lock()
+	t.deleteMarkers++
+	t.mutex.Unlock()
+	return &TargetResult{}
+}
+
+func (t *NullTarget) Verify() bool {
+	return true
+}
+
+func (t *NullTarget) Close() {
+	t.logger.Event("Null target discarded versions: ", t.versions, " delete markers: ", t.deleteMarkers)
+}
@@ -0,0 +1,126 @@
+// uploads completed versions to the target with a pool of workers so reading tape
+// does not wait on the target
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// a version whose blocks are all cached, or a delete marker, ready to send to the target
+type uploadJob struct {
+	versionID    string
+	bucket       string
+	key          string
+	deleteMarker bool
+	blockids     []string // sorted in logical order
+	meta         *VersionMeta
+	sources      []ManifestSource
+}
+
+// each key is always sent to the same worker so versions and delete markers of a key
+// reach the target in the order they are queued
+type Uploader struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	queues   [][]*uploadJob
+	queued   int // jobs queued or being uploaded
+	uploaded int // versions and delete markers sent to the target
+	depth    int // readers wait when this many jobs are queued
+	closed   bool
+	done     sync.WaitGroup
+	dbm      *DBManager
+}
+
+func NewUploader(workers, depth int, dbm *DBManager) *Uploader {
+	if workers < 1 {
+		workers = 1
+	}
+	if depth < 1 {
+		depth = 1
+	}
+	u := &Uploader{
+		queues: make([][]*uploadJob, workers),
+		depth:  depth,
+		dbm:    dbm,
+	}
+	u.cond = sync.NewCond(&u.mutex)
+	for i := 0; i < workers; i++ {
+		u.done.Add(1)
+		go u.worker(i)
+	}
+	return u
+}
+
+// queue a job without blocking, called with the database locked so jobs are
+// queued in the order the versions completed
+func (u *Uploader) Enqueue(job *uploadJob) {
+	hash := fnv.New32a()
+	hash.Write([]byte(job.bucket + "/" + job.key))
+	worker := int(hash.Sum32() % uint32(len(u.queues)))
+
+	u.mutex.Lock()
+	u.queues[worker] = append(u.queues[worker], job)
+	u.queued++
+	u.cond.Broadcast()
+	u.mutex.Unlock()
+}
+
+// block while the queue is full, called by readers with the database unlocked
+func (u *Uploader) WaitForRoom() {
+	u.mutex.Lock()
+	for u.queued >= u.depth && !u.closed {
+		u.cond.Wait()
+	}
+	u.mutex.Unlock()
+}
+
+// wait for the queued jobs to be uploaded and stop the workers
+func (u *Uploader) Close() {
+	u.mutex.Lock()
+	u.closed = true
+	u.cond.Broadcast()
+	u.mutex.Unlock()
+	u.done.Wait()
+}
+
+func (u *Uploader) worker(i int) {
+	defer u.done.Done()
+	for {
+		u.mutex.Lock()
+		for len(u.queues[i]) == 0 && !u.closed {
+			u.cond.Wait()
+		}
+		if len(u.queues[i]) == 0 {
+			u.mutex.Unlock()
+			return
+		}
+		job := u.queues[i][0]
+		u.queues[i] = u.queues[i][1:]
+		u.mutex.Unlock()
+
+		u.dbm.upload(job)
+
+		u.mutex.Lock()
+		u.queued--
+		u.uploaded++
+		u.cond.Broadcast()
+		u.mutex.Unlock()
+		// readers waiting on the cache quota check the uploads again
+		u.dbm.cache.Wake()
+	}
+}
+
+// returns the number of versions queued or being uploaded
+func (u *Uploader) Pending() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.queued
+}
+
+// returns the versions uploaded and the versions queued or being uploaded
+func (u *Uploader) Counts() (int, int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.uploaded, u.queued
+}
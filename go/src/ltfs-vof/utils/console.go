@@ -0,0 +1,9 @@
+package utils
+
+import (
+	"io"
+	"os"
+)
+
+// where messages for the operator are printed, stderr when a tar stream is written to stdout
+var Console io.Writer = os.Stdout
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"sync"
+)
+
+// lets a run be paused, resumed or stopped from another goroutine such as a signal handler
+type RunControl struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	paused   bool
+	stopping bool
+}
+
+func NewRunControl() *RunControl {
+	var control RunControl
+	control.cond = sync.NewCond(&control.mutex)
+	return &control
+}
+func (c *RunControl) Pause() {
+	c.mutex.Lock()
+	c.paused = true
+	c.mutex.Unlock()
+}
+func (c *RunControl) Resume() {
+	c.mutex.Lock()
+	c.paused = false
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+}
+
+// ask the run to stop, paused work is woken so it can stop
+func (c *RunControl) Stop() {
+	c.mutex.Lock()
+	c.stopping = true
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+}
+func (c *RunControl) Stopping() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.stopping
+}
+func (c *RunControl) Paused() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.paused
+}
+
+// block while paused, returns false if the run is stopping
+func (c *RunControl) Wait() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for c.paused && !c.stopping {
+		c.cond.Wait()
+	}
+	return !c.stopping
+}
@@ -35,11 +35,11 @@ func (l *Logger) Event(message ...any) {
 	defer f.Close()
 	// write the header to the file
 	if _, err := fmt.Fprintf(f, " %s\n\tEvent: ", l.getHeader()); err != nil {
-		fmt.Println("Error writing event to log file:", err)
+		fmt.Fprintln(Console, "Error writing event to log file:", err)
 	}
 	// write the message to the file
 	if _, err := fmt.Fprintln(f, message); err != nil {
-		fmt.Println("Error writing event to log file:", err)
+		fmt.Fprintln(Console, "Error writing event to log file:", err)
 	}
 }
 func (l *Logger) Fatal(message ...any) {
@@ -51,13 +51,13 @@ func (l *Logger) Fatal(message ...any) {
 	defer f.Close()
 	// write the header to the file
 	if _, err := fmt.Fprintf(f, "%s \n\tFatal: ", l.getHeader()); err != nil {
-		fmt.Println("Error writing event to log file:", err)
+		fmt.Fprintln(Console, "Error writing event to log file:", err)
 	}
 	// write the message to the file
 	if _, err := fmt.Fprintln(f, message); err != nil {
-		fmt.Println("Error writing fatal to log file:", err)
+		fmt.Fprintln(Console, "Error writing fatal to log file:", err)
 	}
-	fmt.Println("Fatal error:", message)
+	fmt.Fprintln(Console, "Fatal error:", message)
 	os.Exit(1)
 }
 func (l *Logger) getHeader() string {
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"log"
+	"time"
 )
 
 // simple resource manager so that not too many file hits are done at one time
@@ -90,6 +91,17 @@ func (r *Resource) Reserve() int {
 	// wait for callback
 	return <-callback
 }
+
+// request a resource but give up if none is free within the timeout
+func (r *Resource) ReserveWithin(timeout time.Duration) (int, bool) {
+	callback := make(chan int)
+	select {
+	case r.reserveChan <- callback:
+		return <-callback, true
+	case <-time.After(timeout):
+		return 0, false
+	}
+}
 func (r *Resource) Release(i int) {
 	// send request with callback as argument
 	r.releaseChan <- i
@@ -0,0 +1,96 @@
+// keeps each restored version and the version ID the target gave it, if any, so the
+// original Vail version can be found after its row in the versions table is removed
+package main
+
+import (
+	"fmt"
+	. "ltfs-vof/utils"
+	"strings"
+	"time"
+)
+
+// an original version and the version the target created for it
+type VersionMapping struct {
+	VersionID       string
+	TargetVersionID string
+	Bucket          string
+	Key             string
+	TargetBucket    string
+	TargetKey       string
+	DeleteMarker    bool
+	Restored        time.Time
+}
+
+func (dbm *DBManager) createVersionMapTable() {
+	_, err := dbm.db.Exec(`CREATE TABLE IF NOT EXISTS versionmap (versionid TEXT NOT NULL PRIMARY KEY, targetversionid TEXT, bucket TEXT, objectkey TEXT, targetbucket TEXT, targetkey TEXT, deletemarker BOOL default false, restored INT)`)
+	if err != nil {
+		dbm.logger.Fatal("Could not create version map table", err)
+	}
+	// catalogs made before the target bucket and key were kept get the columns added
+	for _, column := range []string{"targetbucket", "targetkey"} {
+		_, err = dbm.db.Exec(`ALTER TABLE versionmap ADD COLUMN ` + column + ` TEXT`)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			dbm.logger.Fatal("Could not add ", column, " column to version map table", err)
+		}
+	}
+	_, err = dbm.db.Exec(`CREATE INDEX IF NOT EXISTS versionmap_target ON versionmap (targetversionid)`)
+	if err != nil {
+		dbm.logger.Fatal("Could not create version map index", err)
+	}
+}
+
+func (dbm *DBManager) insertVersionMap(mapping *VersionMapping) {
+	sql := "INSERT or REPLACE INTO versionmap (versionid, targetversionid, bucket, objectkey, targetbucket, targetkey, deletemarker, restored) VALUES (?,?,?,?,?,?,?,?)"
+	_, err := dbm.db.Exec(sql, mapping.VersionID, mapping.TargetVersionID, mapping.Bucket, mapping.Key, mapping.TargetBucket, mapping.TargetKey, mapping.DeleteMarker, mapping.Restored.Unix())
+	if err != nil {
+		dbm.logger.Fatal("Could not insert version map for version: ", mapping.VersionID, err)
+	}
+}
+
+// returns the mappings whose original or target version ID is the ID given
+func (dbm *DBManager) LookupVersion(versionID string) []*VersionMapping {
+	dbm.lock()
+	defer dbm.unlock()
+	rows, err := dbm.db.Query("SELECT versionid, targetversionid, bucket, objectkey, COALESCE(targetbucket, ''), COALESCE(targetkey, ''), deletemarker, restored FROM versionmap WHERE versionid = ? OR targetversionid = ?", versionID, versionID)
+	if err != nil {
+		dbm.logger.Fatal("Could not read version map", err)
+	}
+	defer rows.Close()
+	var mappings []*VersionMapping
+	for rows.Next() {
+		var mapping VersionMapping
+		var deleteMarker int
+		var restored int64
+		err = rows.Scan(&mapping.VersionID, &mapping.TargetVersionID, &mapping.Bucket, &mapping.Key, &mapping.TargetBucket, &mapping.TargetKey, &deleteMarker, &restored)
+		if err != nil {
+			dbm.logger.Fatal("Could not read version map", err)
+		}
+		mapping.DeleteMarker = deleteMarker == 1
+		// only the S3 target returns the names it wrote, the others and rows kept before the names
+		// were recorded use the source names
+		if mapping.TargetBucket == "" {
+			mapping.TargetBucket, mapping.TargetKey = mapping.Bucket, mapping.Key
+		}
+		mapping.Restored = time.Unix(restored, 0)
+		mappings = append(mappings, &mapping)
+	}
+	return mappings
+}
+
+// print the restored version of an original version ID or the original of a target version ID
+func (db *Database) PrintVersionLookup(versionID string) int {
+	mappings := db.dbManager.LookupVersion(versionID)
+	if len(mappings) == 0 {
+		fmt.Fprintln(Console, "No restored version found for: ", versionID)
+		return 0
+	}
+	for _, mapping := range mappings {
+		targetVersion := mapping.TargetVersionID
+		if targetVersion == "" {
+			targetVersion = "none, the target does not keep versions"
+		}
+		fmt.Fprintf(Console, "Original: %s/%s\n\tOriginal Version: %s\n\tTarget: %s/%s\n\tTarget Version: %s\n\tDelete Marker: %t\n\tRestored: %s\n",
+			mapping.Bucket, mapping.Key, mapping.VersionID, mapping.TargetBucket, mapping.TargetKey, targetVersion, mapping.DeleteMarker, mapping.Restored.Format(time.RFC3339))
+	}
+	return len(mappings)
+}